@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gorpc/codec"
@@ -38,6 +39,7 @@ func (c *Call) done() {
 // 可能存在一个客户端关联多个未完成的调用
 // 并且被多个goroutine运行的情况
 type Client struct {
+	lastRecv int64            // 最近一次收到服务端消息的时间(UnixNano), 用于心跳检测
 	cc       codec.Codec      // 消息编解码器, 序列化将要发送出去的请求，以及反序列化接收到的响应
 	opt      *option.Option   // rpc的参数, 包含魔数和 codec.Type
 	sending  sync.Mutex       // 保证请求的有序发送, 避免出现多个请求报文混淆
@@ -47,6 +49,8 @@ type Client struct {
 	pending  map[uint64]*Call // 存储未处理完的请求, 键是编号, 值是 Call 实例
 	closing  bool             // 标识服务器关闭, 由用户主动关闭
 	shutdown bool             // 标识服务器关闭, 一般是错误产生导致的关闭
+	expired  bool             // 标识心跳超时, 连接被主动断开
+	done     chan struct{}    // 连接结束时关闭, 通知等待方
 }
 
 // 保证Client的方法都已实现
@@ -54,6 +58,18 @@ var _ io.Closer = (*Client)(nil)
 
 var ErrShutdown = errors.New("连接已经关闭")
 
+// ErrConnectTimeout 建立连接超过 Option.ConnectTimeout, 请求还没有发出
+var ErrConnectTimeout = errors.New("rpc client: 连接超时")
+
+// ErrUnavailable 心跳超时, 对端已不可用
+var ErrUnavailable = errors.New("rpc client: 心跳超时, 连接不可用")
+
+// drainInterval Drain 检查未完成调用数的间隔
+const drainInterval = 10 * time.Millisecond
+
+// heartbeatBody 心跳帧的消息体
+var heartbeatBody = struct{}{}
+
 // Close 关闭连接
 func (c *Client) Close() error {
 	c.mu.Lock()
@@ -72,6 +88,32 @@ func (c *Client) IsAvailable() bool {
 	return !c.shutdown && !c.closing
 }
 
+// NumPending 返回已发送但还没有收到响应的调用数
+func (c *Client) NumPending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Drain 等待未完成的调用全部返回后关闭连接, 超过 timeout 仍未返回的调用会随连接关闭而失败
+func (c *Client) Drain(timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(drainInterval)
+	defer tick.Stop()
+	for c.NumPending() > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			return c.Close()
+		case <-c.done:
+			// 连接已经断开, 未完成的调用都已结束
+			return c.Close()
+		}
+	}
+	return c.Close()
+}
+
 // registerCall 注册调用, 并更新 c.seq
 func (c *Client) registerCall(call *Call) (uint64, error) {
 	c.mu.Lock()
@@ -102,10 +144,12 @@ func (c *Client) terminateCalls(err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.shutdown = true
-	for _, call := range c.pending {
+	for seq, call := range c.pending {
 		call.Error = err
 		call.done()
+		delete(c.pending, seq)
 	}
+	close(c.done)
 }
 
 // receive 接收响应
@@ -122,6 +166,14 @@ func (c *Client) receive() {
 		if err = c.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		atomic.StoreInt64(&c.lastRecv, time.Now().UnixNano())
+		// 心跳帧不对应任何调用, 收到服务端的 ping 需要回复 pong
+		if h.IsHeartbeat() {
+			if err = c.cc.ReadBody(nil); err == nil && h.ServiceMethod == codec.PingMethod {
+				go c.heartbeat(codec.PongMethod)
+			}
+			continue
+		}
 		// 从 pending 队列中移除本次调用
 		call := c.removeCall(h.Seq)
 		switch {
@@ -141,9 +193,48 @@ func (c *Client) receive() {
 		}
 	}
 	// 发生错误, 结束 pending 队列中的剩余调用
+	c.mu.Lock()
+	if c.expired {
+		err = ErrUnavailable
+	}
+	c.mu.Unlock()
 	c.terminateCalls(err)
 }
 
+// heartbeat 发送心跳帧, method 为 codec.PingMethod 或 codec.PongMethod
+func (c *Client) heartbeat(method string) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	c.header.ServiceMethod = method
+	c.header.Seq = 0
+	c.header.Error = ""
+	if err := c.cc.Write(&c.header, heartbeatBody); err != nil {
+		log.Println("rpc client: 发送心跳出错 ", err)
+	}
+}
+
+// keepalive 定时向服务端发送 ping 帧
+// 超过 timeout 未收到服务端的任何消息时断开连接, 所有未完成的调用以 ErrUnavailable 结束
+func (c *Client) keepalive(interval, timeout time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		if !c.IsAvailable() {
+			return
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRecv))) > timeout {
+			log.Printf("rpc client: 心跳超时, 超时时间为%s, 断开连接\n", timeout)
+			c.mu.Lock()
+			c.expired = true
+			c.mu.Unlock()
+			// 关闭连接后 receive 退出循环, 由 receive 结束剩余调用
+			_ = c.cc.Close()
+			return
+		}
+		c.heartbeat(codec.PingMethod)
+	}
+}
+
 // send 发送请求
 func (c *Client) send(call *Call) {
 	// 确保完整发送一次请求
@@ -195,12 +286,21 @@ func (c *Client) Call(ctx context.Context, serviceMethod string, args, reply int
 	select {
 	case <-ctx.Done():
 		c.removeCall(call.Seq)
-		return errors.New("rpc client: 调用失败 " + ctx.Err().Error())
+		return fmt.Errorf("rpc client: 调用失败 %w", ctx.Err())
 	case call = <-call.Done:
 		return call.Error
 	}
 }
 
+// HealthCheck 调用服务端内置的 server.HealthCheckMethod, 返回服务 service 的健康状态, service 为空时返回整个服务端的健康状态
+func (c *Client) HealthCheck(ctx context.Context, service string) (server.HealthStatus, error) {
+	var resp server.HealthCheckResponse
+	if err := c.Call(ctx, server.HealthCheckMethod, server.HealthCheckRequest{Service: service}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Status, nil
+}
+
 // NewClient 创建 rpc 客户端实例
 func NewClient(conn net.Conn, opt *option.Option) (*Client, error) {
 	// 通过 opt.CodecType 获取编解码函数
@@ -221,13 +321,19 @@ func NewClient(conn net.Conn, opt *option.Option) (*Client, error) {
 
 func newClientCodec(cc codec.Codec, opt *option.Option) *Client {
 	client := &Client{
-		cc:      cc,
-		opt:     opt,
-		seq:     1, // 请求编号从1开始, 0代表非法调用
-		pending: make(map[uint64]*Call),
+		lastRecv: time.Now().UnixNano(),
+		cc:       cc,
+		opt:      opt,
+		seq:      1, // 请求编号从1开始, 0代表非法调用
+		pending:  make(map[uint64]*Call),
+		done:     make(chan struct{}),
 	}
 	// 开启子协程接收响应
 	go client.receive()
+	// 开启子协程发送心跳
+	if interval, timeout := opt.KeepAlive(); interval > 0 {
+		go client.keepalive(interval, timeout)
+	}
 	return client
 }
 
@@ -280,7 +386,7 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*option.Optio
 	}
 	select {
 	case <-time.After(opt.ConnectTimeout):
-		return nil, fmt.Errorf("rpc client: 连接超时, 超时时间为%s", opt.ConnectTimeout)
+		return nil, fmt.Errorf("%w, 超时时间为%s", ErrConnectTimeout, opt.ConnectTimeout)
 	case result := <-ch:
 		return result.client, result.err
 	}
@@ -2,7 +2,9 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -31,7 +33,7 @@ func TestClient_dialTimeout(t *testing.T) {
 	}
 	t.Run("timeout", func(t *testing.T) {
 		_, err := dialTimeout(f, "tcp", lis.Addr().String(), &option.Option{ConnectTimeout: time.Second})
-		_assert(err != nil && strings.Contains(err.Error(), "连接超时"), "expect a timeout error")
+		_assert(errors.Is(err, ErrConnectTimeout), "expect a timeout error")
 	})
 	t.Run("0", func(t *testing.T) {
 		_, err := dialTimeout(f, "tcp", lis.Addr().String(), &option.Option{ConnectTimeout: 0})
@@ -97,3 +99,60 @@ func TestXDial(t *testing.T) {
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+func TestClient_KeepAlive(t *testing.T) {
+	t.Parallel()
+	// 模拟一个只接收数据, 从不回复的对端
+	lis, _ := net.Listen("tcp", ":0")
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	client, err := Dial("tcp", lis.Addr().String(), &option.Option{
+		KeepAliveInterval: 100 * time.Millisecond,
+		KeepAliveTimeout:  300 * time.Millisecond,
+	})
+	_assert(err == nil, "failed to dial: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Bar.Timeout", 1, &reply)
+	_assert(err == ErrUnavailable, "expect ErrUnavailable, but got %v", err)
+	_assert(!client.IsAvailable(), "client should be unavailable after keepalive timeout")
+}
+
+func TestReconnectClient(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	_ = server.Register(&b)
+	lis, _ := net.Listen("tcp", ":0")
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go server.DefaultServer.ServeConn(conn)
+		}
+	}()
+	backoff := &Backoff{Initial: 50 * time.Millisecond, Max: 200 * time.Millisecond, Multiplier: 2}
+	rc, err := DialReconnect("tcp@"+lis.Addr().String(), QueueOnReconnect, backoff)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = rc.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var reply int
+	err = rc.Call(ctx, "Bar.Timeout", 1, &reply)
+	_assert(err == nil, "failed to call: %v", err)
+	// 服务端断开连接后, 排队的调用应在重连成功后完成
+	_ = (<-conns).Close()
+	for rc.IsAvailable() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = rc.Call(ctx, "Bar.Timeout", 1, &reply)
+	_assert(err == nil, "expect call to succeed after reconnect, but got %v", err)
+	_assert(len(conns) == 1, "expect a new connection after reconnect")
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gorpc/option"
+)
+
+// Backoff 指数退避参数
+// 第 n 次重试的等待时间为 Initial * Multiplier^n, 不超过 Max, 并叠加 ±Jitter 比例的随机抖动
+type Backoff struct {
+	Initial    time.Duration // 首次等待时间
+	Max        time.Duration // 最长等待时间
+	Multiplier float64       // 每次等待时间的增长倍数
+	Jitter     float64       // 抖动比例, 0.2 表示在 ±20% 范围内随机, 避免大量客户端同时重试
+}
+
+// DefaultBackoff 默认的退避参数
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        10 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Duration 返回第 attempt 次(从 0 开始)重试前需要等待的时间
+func (b Backoff) Duration(attempt int) time.Duration {
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+// ReconnectPolicy 重连期间新发起的调用的处理策略
+type ReconnectPolicy int
+
+const (
+	QueueOnReconnect    ReconnectPolicy = iota // 排队等待重连成功后再发送, 直到 ctx 结束
+	FailFastOnReconnect                        // 立即返回 ErrReconnecting
+)
+
+// ErrReconnecting 连接断开, 正在重连
+var ErrReconnecting = errors.New("rpc client: 连接断开, 正在重连")
+
+// ReconnectClient 断线自动重连的客户端
+// 底层 Client 因出错关闭后, 按指数退避重新拨号并重新发送 Option 完成握手
+type ReconnectClient struct {
+	rpcAddr string
+	opt     *option.Option
+	policy  ReconnectPolicy
+	backoff Backoff
+	mu      sync.Mutex    // 保护以下字段
+	client  *Client       // 当前可用的连接, 重连期间为 nil
+	ready   chan struct{} // 下一次重连成功或关闭时关闭, 唤醒排队的调用
+	closing bool          // 用户主动关闭
+	closed  chan struct{} // 用户主动关闭时关闭, 结束重连
+}
+
+// 保证ReconnectClient的方法都已实现
+var _ io.Closer = (*ReconnectClient)(nil)
+
+// DialReconnect 创建断线自动重连的客户端, rpcAddr 的格式与 XDial 相同
+// backoff 为 nil 时使用 DefaultBackoff, 首次拨号失败时直接返回错误
+func DialReconnect(rpcAddr string, policy ReconnectPolicy, backoff *Backoff, opts ...*option.Option) (*ReconnectClient, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	c, err := XDial(rpcAddr, opt)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReconnectClient{
+		rpcAddr: rpcAddr,
+		opt:     opt,
+		policy:  policy,
+		backoff: DefaultBackoff,
+		client:  c,
+		ready:   make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	if backoff != nil {
+		rc.backoff = *backoff
+	}
+	go rc.run(c)
+	return rc, nil
+}
+
+// run 等待当前连接结束, 然后重连, 直到用户主动关闭
+func (rc *ReconnectClient) run(c *Client) {
+	for {
+		select {
+		case <-rc.closed:
+			return
+		case <-c.done:
+		}
+		rc.mu.Lock()
+		rc.client = nil
+		rc.mu.Unlock()
+		log.Println("rpc client: 连接断开, 开始重连 ", rc.rpcAddr)
+		if c = rc.redial(); c == nil {
+			return
+		}
+		rc.mu.Lock()
+		if rc.closing {
+			rc.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+		rc.client = c
+		close(rc.ready)
+		rc.ready = make(chan struct{})
+		rc.mu.Unlock()
+		log.Println("rpc client: 重连成功 ", rc.rpcAddr)
+	}
+}
+
+// redial 按指数退避重新拨号, 用户主动关闭时返回 nil
+func (rc *ReconnectClient) redial() *Client {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-rc.closed:
+			return nil
+		case <-time.After(rc.backoff.Duration(attempt)):
+		}
+		c, err := XDial(rc.rpcAddr, rc.opt)
+		if err == nil {
+			return c
+		}
+		log.Printf("rpc client: 第%d次重连失败 %s err: %v\n", attempt+1, rc.rpcAddr, err)
+	}
+}
+
+// get 返回可用的连接, 重连期间根据 policy 等待或直接返回错误
+func (rc *ReconnectClient) get(ctx context.Context) (*Client, error) {
+	for {
+		rc.mu.Lock()
+		if rc.closing {
+			rc.mu.Unlock()
+			return nil, ErrShutdown
+		}
+		c, ready := rc.client, rc.ready
+		rc.mu.Unlock()
+		if c != nil && c.IsAvailable() {
+			return c, nil
+		}
+		if rc.policy == FailFastOnReconnect {
+			return nil, ErrReconnecting
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("rpc client: 等待重连失败 %w", ctx.Err())
+		case <-ready:
+		}
+	}
+}
+
+// Call 同步调用, 连接断开时的行为由 ReconnectPolicy 决定
+// 已经发出但连接断开的调用不会重发, 直接返回错误
+func (rc *ReconnectClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	c, err := rc.get(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Call(ctx, serviceMethod, args, reply)
+}
+
+// IsAvailable 当前连接可用时返回true
+func (rc *ReconnectClient) IsAvailable() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return !rc.closing && rc.client != nil && rc.client.IsAvailable()
+}
+
+// Close 关闭客户端, 停止重连, 排队中的调用返回 ErrShutdown
+func (rc *ReconnectClient) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closing {
+		return ErrShutdown
+	}
+	rc.closing = true
+	close(rc.closed)
+	close(rc.ready)
+	if rc.client != nil {
+		return rc.client.Close()
+	}
+	return nil
+}
@@ -17,6 +17,18 @@ type Codec interface {
 	Write(head *Header, body interface{}) error
 }
 
+// 心跳帧的 ServiceMethod, 复用 Header 在同一个连接上收发, 不对应任何服务方法
+// 心跳帧的 Seq 固定为 0, 不会与正常的调用混淆
+const (
+	PingMethod = "_gorpc_.Ping"
+	PongMethod = "_gorpc_.Pong"
+)
+
+// IsHeartbeat 判断是否为心跳帧
+func (h *Header) IsHeartbeat() bool {
+	return h.ServiceMethod == PingMethod || h.ServiceMethod == PongMethod
+}
+
 // NewCodecFunc 新建Codec对象的函数类型
 type NewCodecFunc func(closer io.ReadWriteCloser) Codec
 
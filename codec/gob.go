@@ -32,17 +32,20 @@ func (c GobCodec) ReadBody(body interface{}) error {
 // Write 将header和body编码, 写入缓冲区后刷新并关闭
 func (c GobCodec) Write(header *Header, body interface{}) (err error) {
 	defer func() {
-		_ = c.buf.Flush()
+		// 连接断开时 Flush 会返回错误, 同样需要关闭连接
+		if flushErr := c.buf.Flush(); err == nil {
+			err = flushErr
+		}
 		if err != nil {
 			_ = c.Close()
 		}
 	}()
 	if err = c.enc.Encode(header); err != nil {
-		log.Fatalln("rpc codec: gob编码header出错 err: ", err)
+		log.Println("rpc codec: gob编码header出错 err: ", err)
 		return err
 	}
 	if err = c.enc.Encode(body); err != nil {
-		log.Fatalln("rpc codec: gob编码body出错 err: ", err)
+		log.Println("rpc codec: gob编码body出错 err: ", err)
 		return err
 	}
 	return nil
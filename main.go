@@ -33,6 +33,8 @@ func (f Foo) Sleep(args Args, reply *int) error {
 func startRegistry(wg *sync.WaitGroup) {
 	lis, _ := net.Listen("tcp", ":9999")
 	registry.HandleHTTP()
+	// 主动检查实例内置的健康检查服务, 摘除不能提供服务的实例
+	registry.DefaultGoRegistry.StartHealthCheck(context.Background(), registry.DefaultHealthCheckPolicy)
 	wg.Done()
 	_ = http.Serve(lis, nil)
 }
@@ -46,7 +48,9 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 	s := server.NewServer()
 	var foo Foo
 	_ = s.Register(&foo)
-	registry.Heartbeat(registryAddr, "tcp@"+lis.Addr().String(), 0)
+	h := registry.Heartbeat(registryAddr, "tcp@"+lis.Addr().String(), 0, s.Services()...)
+	// 服务关闭时立即从注册中心注销
+	s.RegisterOnShutdown(func() { _ = h.Stop() })
 	log.Println("启动rpc服务器 ", lis.Addr())
 	wg.Done()
 	s.Accept(lis)
@@ -74,11 +78,9 @@ func foo(xc *xclient.XClient, ctx context.Context, typ, serviceMethod string, ar
 func simulateCall(registry, typ string, owg *sync.WaitGroup) {
 	// 创建服务注册中心
 	d := xclient.NewGoRegistryDiscovery(registry, 0)
-	// 创建带负载均衡的客户端
+	// 创建带负载均衡的客户端, 关闭时一并停止服务发现的后台刷新
 	xc := xclient.NewXClient(d, xclient.RandomSelect, nil)
-	defer func() {
-		_ = xc.Close()
-	}()
+	defer func() { _ = xc.Close() }()
 	var wg sync.WaitGroup
 	for i := 0; i < 5; i++ {
 		wg.Add(1)
@@ -14,6 +14,20 @@ type Option struct {
 	CodecType      codec.Type    // client端可以选择不同的Codec来编码body
 	ConnectTimeout time.Duration // 0 表示不设限
 	HandleTimeout  time.Duration
+	// 心跳间隔, 客户端和服务端都会按该间隔发送 ping 帧, 0 表示不发送心跳
+	// 默认关闭: 不支持 ping 帧的旧版本服务端无法解析心跳, 只有确认服务端均已升级后才能开启
+	KeepAliveInterval time.Duration
+	// 超过该时间未收到对端任何帧则断开连接, 0 表示 3 倍心跳间隔
+	KeepAliveTimeout time.Duration
+}
+
+// KeepAlive 返回心跳间隔和心跳超时时间
+func (o *Option) KeepAlive() (interval, timeout time.Duration) {
+	interval, timeout = o.KeepAliveInterval, o.KeepAliveTimeout
+	if interval > 0 && timeout == 0 {
+		timeout = 3 * interval
+	}
+	return
 }
 
 var DefaultOption = &Option{
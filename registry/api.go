@@ -0,0 +1,194 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix JSON API 的路径前缀, 位于注册路径之后, 例如 /_gorpc_/registry/v1
+//
+//	GET    {registry}/v1/instances                    列出实例, 参数 service 过滤服务, 参数 revision 不为空时为 watch 请求
+//	POST   {registry}/v1/instances                    注册实例, 请求体为 ServerItem, 响应体为 instanceResponse
+//	GET    {registry}/v1/instances/{addr}             查询实例, 不健康的实例也会被返回, 响应体为 instanceResponse
+//	PUT    {registry}/v1/instances/{addr}/heartbeat   心跳保活, 实例不存在时返回 404, 需要重新注册
+//	DELETE {registry}/v1/instances/{addr}             注销实例
+//
+// {addr} 为经过 url.PathEscape 编码的实例地址, 出错时响应体为 apiError
+const apiPrefix = "/v1/"
+
+// instanceResponse 查询和注册单个实例的响应体, Healthy 为 false 时实例被主动健康检查判定为不健康, 不会出现在实例列表中
+type instanceResponse struct {
+	ServerItem
+	Healthy bool `json:"healthy"`
+}
+
+// apiError JSON API 的错误响应
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON 以 JSON 格式写入响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError 以 JSON 格式写入错误响应
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+// serveAPI 处理 JSON API 的请求, path 为 apiPrefix 之后未解码的路径
+// 先分段再逐段解码, 实例地址中编码后的 / 不会被当作分隔符, 例如 unix@/tmp/gorpc.sock
+func (r *GoRegistry) serveAPI(w http.ResponseWriter, req *http.Request, path string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		v, err := url.PathUnescape(part)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "rpc registry: 路径不正确 "+part)
+			return
+		}
+		parts[i] = v
+	}
+	if parts[0] != "instances" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "rpc registry: 未知的路径 "+req.URL.Path)
+		return
+	}
+	if len(parts) == 1 {
+		r.serveInstances(w, req)
+		return
+	}
+	addr := parts[1]
+	if addr == "" {
+		writeError(w, http.StatusBadRequest, "rpc registry: 缺少实例地址")
+		return
+	}
+	if len(parts) == 3 {
+		if parts[2] != "heartbeat" {
+			writeError(w, http.StatusNotFound, "rpc registry: 未知的路径 "+req.URL.Path)
+			return
+		}
+		if req.Method != "PUT" {
+			writeError(w, http.StatusMethodNotAllowed, "rpc registry: 不支持的请求方法 "+req.Method)
+			return
+		}
+		if !r.touchServer(addr) {
+			writeError(w, http.StatusNotFound, "rpc registry: 实例不存在 "+addr)
+			return
+		}
+		// 其他节点只能通过转发的心跳刷新实例的超时时间
+		r.replicateServer(req, addr)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	r.serveInstance(w, req, addr)
+}
+
+// serveInstances 处理 {registry}/v1/instances 的请求
+func (r *GoRegistry) serveInstances(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		var alive []ServerItem
+		var revision uint64
+		query := req.URL.Query()
+		if v := query.Get("revision"); v != "" {
+			watched, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "rpc registry: revision 不正确 "+v)
+				return
+			}
+			alive, revision = r.watch(req.Context(), watched, defaultWatchTimeout)
+		} else {
+			alive, revision, _, _ = r.snapshot()
+		}
+		alive = filter(alive, query.Get("service"))
+		if alive == nil {
+			alive = []ServerItem{}
+		}
+		writeJSON(w, http.StatusOK, registryResponse{Revision: revision, Servers: alive})
+	case "POST":
+		var item ServerItem
+		if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+			writeError(w, http.StatusBadRequest, "rpc registry: 请求体不正确 "+err.Error())
+			return
+		}
+		if item.Addr == "" {
+			writeError(w, http.StatusBadRequest, "rpc registry: 缺少实例地址")
+			return
+		}
+		r.putServer(item, true)
+		item, _ = r.getServer(item.Addr)
+		r.replicate(req, item.Addr, &item)
+		writeJSON(w, http.StatusOK, instanceResponse{ServerItem: item, Healthy: !item.unhealthy})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "rpc registry: 不支持的请求方法 "+req.Method)
+	}
+}
+
+// serveInstance 处理 {registry}/v1/instances/{addr} 的请求
+func (r *GoRegistry) serveInstance(w http.ResponseWriter, req *http.Request, addr string) {
+	switch req.Method {
+	case "GET":
+		item, ok := r.getServer(addr)
+		if !ok {
+			writeError(w, http.StatusNotFound, "rpc registry: 实例不存在 "+addr)
+			return
+		}
+		writeJSON(w, http.StatusOK, instanceResponse{ServerItem: item, Healthy: !item.unhealthy})
+	case "DELETE":
+		r.replicate(req, addr, nil)
+		if !r.removeServer(addr) {
+			writeError(w, http.StatusNotFound, "rpc registry: 实例不存在 "+addr)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "rpc registry: 不支持的请求方法 "+req.Method)
+	}
+}
+
+// getServer 返回未超时的实例
+func (r *GoRegistry) getServer(addr string) (ServerItem, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.servers[addr]
+	if s == nil || r.expired(s) {
+		return ServerItem{}, false
+	}
+	return *s, true
+}
+
+// touchServer 更新未超时的实例的启动时间保活, 实例不存在时返回 false
+func (r *GoRegistry) touchServer(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.servers[addr]
+	if s == nil || r.expired(s) {
+		return false
+	}
+	s.start = time.Now()
+	return true
+}
+
+// removeServer 删除实例, 实例不存在时返回 false
+func (r *GoRegistry) removeServer(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.servers[addr]; !ok {
+		return false
+	}
+	delete(r.servers, addr)
+	r.record(addr, nil)
+	r.bump()
+	return true
+}
+
+// expired 判断实例是否已经超时, 需要持有 r.mu
+func (r *GoRegistry) expired(s *ServerItem) bool {
+	return r.timeout != 0 && !s.start.Add(r.timeout).After(time.Now())
+}
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// replicatedHeader 标记由其他注册中心节点转发的请求, 收到后不再转发, 避免在节点之间循环
+const replicatedHeader = "X-Gorpc-Replicated"
+
+const (
+	// peerTimeout 向其他节点转发变化和同步实例列表的超时时间
+	peerTimeout = time.Second
+	// peerQueueSize 每个节点待转发的变化的最大数量, 超过后丢弃, 由实例的下一次心跳修复
+	peerQueueSize = 1024
+)
+
+// peer 集群中的其他注册中心节点
+type peer struct {
+	url string
+	ops chan journalEntry // 待转发的变化, 按顺序发送, Item 为 nil 时为删除实例 Addr
+}
+
+// SetPeers 设置集群中的其他注册中心节点, 地址与 Heartbeat 使用的注册中心地址相同
+// 每个节点都可以接收注册、心跳和注销, 并转发给所有其他节点, 因此每个节点都需要设置除自己以外的所有节点
+// 设置时先从其他节点同步实例列表, 节点重启或者新加入集群后不需要等待实例的下一次心跳
+// 转发失败时只记录日志, 实例的下一次心跳会修复不一致, 通过 Close 停止转发
+func (r *GoRegistry) SetPeers(peers ...string) {
+	for _, url := range peers {
+		items, err := fetchPeer(url)
+		if err != nil {
+			log.Println("rpc registry: 从其他节点同步实例出错 ", url, err)
+			continue
+		}
+		for _, item := range items {
+			r.putServer(item, true)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopPeers()
+	for _, url := range peers {
+		p := &peer{url: url, ops: make(chan journalEntry, peerQueueSize)}
+		r.peers = append(r.peers, p)
+		r.replicating.Add(1)
+		go r.runPeer(p)
+	}
+}
+
+// stopPeers 停止向其他节点转发, 已经排队的变化仍然会发送, 需要持有 r.mu
+func (r *GoRegistry) stopPeers() {
+	for _, p := range r.peers {
+		close(p.ops)
+	}
+	r.peers = nil
+}
+
+// replicate 将实例的变化转发给其他节点, item 为 nil 时表示删除实例 addr
+// 由其他节点转发的请求不再转发
+func (r *GoRegistry) replicate(req *http.Request, addr string, item *ServerItem) {
+	if req.Header.Get(replicatedHeader) != "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.peers {
+		select {
+		case p.ops <- journalEntry{Item: item, Addr: addr}:
+		default:
+			log.Println("rpc registry: 转发队列已满, 丢弃实例的变化 ", p.url, addr)
+		}
+	}
+}
+
+// replicateServer 将实例 addr 当前的状态转发给其他节点, 实例不存在时不转发
+func (r *GoRegistry) replicateServer(req *http.Request, addr string) {
+	if item, ok := r.getServer(addr); ok {
+		r.replicate(req, addr, &item)
+	}
+}
+
+// runPeer 按顺序将变化发送给节点 p, 直到 p.ops 关闭
+func (r *GoRegistry) runPeer(p *peer) {
+	defer r.replicating.Done()
+	httpClient := &http.Client{Timeout: peerTimeout}
+	for op := range p.ops {
+		var req *http.Request
+		if op.Item != nil {
+			body, _ := json.Marshal(op.Item)
+			req, _ = http.NewRequest("POST", p.url, bytes.NewReader(body))
+			req.Header.Set("Content-Type", jsonContentType)
+		} else {
+			req, _ = http.NewRequest("DELETE", p.url, nil)
+			req.Header.Set("X-Gorpc-Servers", op.Addr)
+		}
+		req.Header.Set(replicatedHeader, "1")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			log.Println("rpc registry: 转发实例的变化出错 ", p.url, err)
+			continue
+		}
+		_ = resp.Body.Close()
+	}
+}
+
+// fetchPeer 从节点 url 获取所有实例
+func fetchPeer(url string) ([]ServerItem, error) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", jsonContentType)
+	resp, err := (&http.Client{Timeout: peerTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rpc registry: 节点返回 %s", resp.Status)
+	}
+	var body registryResponse
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Servers, nil
+}
+
+// Close 停止向其他节点转发并等待已经排队的变化发送完, 然后停止持久化
+func (r *GoRegistry) Close() error {
+	r.mu.Lock()
+	r.stopPeers()
+	r.mu.Unlock()
+	r.replicating.Wait()
+	return r.stopPersist()
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"gorpc/client"
+	"gorpc/option"
+	"gorpc/server"
+)
+
+// HealthCheckPolicy 主动健康检查策略
+type HealthCheckPolicy struct {
+	Interval time.Duration // 两轮检查之间的间隔
+	Timeout  time.Duration // 单次检查的超时时间, 包含建立连接的时间
+	// 连续失败达到该次数后将实例标记为不健康, 不健康的实例不会出现在 GET 的结果中, 小于 1 时按 1 处理
+	// 不健康的实例检查成功一次后立即恢复
+	UnhealthyThreshold int
+}
+
+// DefaultHealthCheckPolicy 默认的主动健康检查策略
+var DefaultHealthCheckPolicy = HealthCheckPolicy{
+	Interval:           10 * time.Second,
+	Timeout:            time.Second,
+	UnhealthyThreshold: 3,
+}
+
+// StartHealthCheck 在后台定时对所有实例进行主动健康检查, 直到 ctx 结束
+// 每次检查都会连接实例并调用 server.HealthCheckMethod, 调用失败或者返回的状态不是 server.Serving 时视为失败
+// 实例没有提供 server.HealthCheckMethod 时无法判断, 视为健康, 只依赖心跳判断实例是否可用
+// 心跳正常但 RPC 服务已经卡死的实例会被排除
+func (r *GoRegistry) StartHealthCheck(ctx context.Context, p HealthCheckPolicy) {
+	if p.UnhealthyThreshold < 1 {
+		p.UnhealthyThreshold = 1
+	}
+	go func() {
+		t := time.NewTicker(p.Interval)
+		defer t.Stop()
+		for {
+			r.checkAll(ctx, p)
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// checkAll 并发检查所有实例, 包括已经被标记为不健康的实例
+func (r *GoRegistry) checkAll(ctx context.Context, p HealthCheckPolicy) {
+	r.mu.Lock()
+	addrs := make([]string, 0, len(r.servers))
+	for addr := range r.servers {
+		addrs = append(addrs, addr)
+	}
+	r.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			r.setHealth(addr, checkHealth(ctx, addr, p.Timeout), p.UnhealthyThreshold)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// checkHealth 连接实例并调用 server.HealthCheckMethod, 实例可以正常提供服务时返回 true
+func checkHealth(ctx context.Context, addr string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	c, err := client.XDial(addr, &option.Option{ConnectTimeout: timeout})
+	if err != nil {
+		return false
+	}
+	defer func() { _ = c.Close() }()
+	status, err := c.HealthCheck(ctx, "")
+	if err != nil {
+		return missingHealthService(err)
+	}
+	return status == server.Serving
+}
+
+// missingHealthService 判断调用失败是否因为实例没有提供 server.HealthCheckMethod, 例如实例使用的是旧版本的 Server
+// 服务端的错误以文本的形式返回, 只能通过 findService 的错误信息判断
+func missingHealthService(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "rpc server: 找不到服务 ") || strings.HasPrefix(msg, "rpc server: 找不到方法 ")
+}
+
+// setHealth 记录一次检查的结果, 实例的健康状态变化时更新实例列表的版本号
+func (r *GoRegistry) setHealth(addr string, healthy bool, threshold int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.servers[addr]
+	if s == nil {
+		return
+	}
+	if healthy {
+		s.failures = 0
+		if s.unhealthy {
+			s.unhealthy = false
+			r.bump()
+		}
+		return
+	}
+	s.failures++
+	if !s.unhealthy && s.failures >= threshold {
+		s.unhealthy = true
+		r.bump()
+	}
+}
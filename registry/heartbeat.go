@@ -0,0 +1,208 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gorpc/client"
+)
+
+// HeartbeatStatus 向单个注册中心发送心跳的状态
+type HeartbeatStatus struct {
+	Registry    string
+	LastSuccess time.Time // 上次发送成功的时间, 零值表示还没有成功过
+	LastError   error     // 最近一次发送的错误, 发送成功时为 nil
+	Failures    int       // 连续失败的次数
+}
+
+// HeartbeatAgent 心跳代理, 定时向一个或多个注册中心发送心跳
+// 发送失败时按 Backoff 退避后重试, 退避时间不超过心跳间隔, 避免实例因为心跳中断而超时
+type HeartbeatAgent struct {
+	registries []string
+	item       ServerItem
+	interval   time.Duration
+	backoff    client.Backoff
+
+	mu     sync.Mutex
+	status map[string]*HeartbeatStatus
+}
+
+// NewHeartbeatAgent 新建心跳代理, interval 为 0 时使用 defaultHeartbeatInterval
+func NewHeartbeatAgent(registries []string, item ServerItem, interval time.Duration) *HeartbeatAgent {
+	if interval == 0 {
+		interval = defaultHeartbeatInterval
+	}
+	a := &HeartbeatAgent{
+		registries: registries,
+		item:       item,
+		interval:   interval,
+		backoff:    client.DefaultBackoff,
+		status:     make(map[string]*HeartbeatStatus),
+	}
+	for _, registry := range registries {
+		a.status[registry] = &HeartbeatStatus{Registry: registry}
+	}
+	return a
+}
+
+// SetBackoff 设置发送失败时的退避参数, 需要在 Run 之前设置
+func (a *HeartbeatAgent) SetBackoff(b client.Backoff) {
+	a.backoff = b
+}
+
+// Status 返回向每个注册中心发送心跳的状态, 顺序与创建时的注册中心相同
+func (a *HeartbeatAgent) Status() []HeartbeatStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := make([]HeartbeatStatus, 0, len(a.registries))
+	for _, registry := range a.registries {
+		status = append(status, *a.status[registry])
+	}
+	return status
+}
+
+// Run 向所有注册中心发送心跳, 直到 ctx 结束, 然后从所有注册中心注销实例, 返回第一个注销的错误
+func (a *HeartbeatAgent) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, registry := range a.registries {
+		wg.Add(1)
+		go func(registry string) {
+			defer wg.Done()
+			a.run(ctx, registry)
+		}(registry)
+	}
+	wg.Wait()
+	var err error
+	for _, registry := range a.registries {
+		if e := Deregister(registry, a.item.Addr); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// run 向单个注册中心发送心跳, 直到 ctx 结束
+func (a *HeartbeatAgent) run(ctx context.Context, registry string) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		err := sendHeartbeat(ctx, registry, a.item, a.interval)
+		if ctx.Err() != nil {
+			return
+		}
+		t.Reset(a.record(registry, err))
+	}
+}
+
+// record 记录一次发送的结果, 返回下一次发送前的等待时间
+func (a *HeartbeatAgent) record(registry string, err error) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.status[registry]
+	st.LastError = err
+	if err == nil {
+		st.LastSuccess = time.Now()
+		st.Failures = 0
+		return a.interval
+	}
+	st.Failures++
+	if d := a.backoff.Duration(st.Failures - 1); d < a.interval {
+		return d
+	}
+	return a.interval
+}
+
+const (
+	// defaultHeartbeatInterval 默认的心跳间隔, 需要明显小于注册中心的超时时间
+	defaultHeartbeatInterval = time.Second
+	// deregisterTimeout 注销实例的超时时间, 避免注册中心不可用时阻塞服务关闭
+	deregisterTimeout = 5 * time.Second
+)
+
+// HeartbeatHandle 后台运行的心跳代理的句柄, 由 Heartbeat 返回
+type HeartbeatHandle struct {
+	*HeartbeatAgent
+	cancel context.CancelFunc
+	done   chan struct{} // Run 返回时关闭
+	err    error         // Run 的返回值
+}
+
+// Stop 停止发送心跳, 并从注册中心注销实例, 返回注销的错误
+// 通常注册到 Server.RegisterOnShutdown, 在服务关闭时立即注销, 不必等待实例超时
+func (h *HeartbeatHandle) Stop() error {
+	h.cancel()
+	<-h.done
+	return h.err
+}
+
+// Heartbeat 在后台向注册中心发送心跳消息保活, services 为实例提供的服务, 通常为 Server.Services 的返回值
+func Heartbeat(registry, addr string, duration time.Duration, services ...string) *HeartbeatHandle {
+	return HeartbeatItem(registry, ServerItem{Addr: addr, Services: services}, duration)
+}
+
+// HeartbeatItem 与 Heartbeat 相同, 但可以携带实例的元数据
+// 需要向多个注册中心发送心跳, 或者需要自行控制退避参数时使用 HeartbeatAgent
+func HeartbeatItem(registry string, item ServerItem, duration time.Duration) *HeartbeatHandle {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &HeartbeatHandle{
+		HeartbeatAgent: NewHeartbeatAgent([]string{registry}, item, duration),
+		cancel:         cancel,
+		done:           make(chan struct{}),
+	}
+	go func() {
+		defer close(h.done)
+		h.err = h.Run(ctx)
+	}()
+	return h
+}
+
+// sendHeartbeat 以 JSON 格式发送实例及其元数据, 同时设置请求头, 兼容只支持请求头的注册中心
+func sendHeartbeat(ctx context.Context, registry string, item ServerItem, timeout time.Duration) error {
+	log.Println(item.Addr, " 发送心跳消息到注册中心 ", registry)
+	httpClient := &http.Client{Timeout: timeout}
+	body, _ := json.Marshal(item)
+	req, _ := http.NewRequestWithContext(ctx, "POST", registry, bytes.NewReader(body))
+	req.Header.Set("Content-Type", jsonContentType)
+	req.Header.Set("X-Gorpc-Servers", item.Addr)
+	if len(item.Services) > 0 {
+		req.Header.Set("X-Gorpc-Services", strings.Join(item.Services, ","))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println("rpc server: 发送心跳消息出错 ", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc registry: 发送心跳消息失败 %s", resp.Status)
+	}
+	return nil
+}
+
+// Deregister 从注册中心注销实例
+func Deregister(registry, addr string) error {
+	req, _ := http.NewRequest("DELETE", registry, nil)
+	req.Header.Set("X-Gorpc-Servers", addr)
+	resp, err := (&http.Client{Timeout: deregisterTimeout}).Do(req)
+	if err != nil {
+		log.Println("rpc server: 注销实例出错 ", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("rpc registry: 注销实例失败 %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package registry
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNamespace 不带命名空间的请求使用的命名空间
+const DefaultNamespace = "default"
+
+// namespacesPath 列出命名空间的路径, 位于注册路径之后
+const namespacesPath = "v1/namespaces"
+
+// ErrNamespaceNotFound 命名空间不存在
+var ErrNamespaceNotFound = errors.New("rpc registry: 命名空间不存在")
+
+// NamespaceRegistry 按命名空间隔离的注册中心, 每个命名空间是一个独立的 GoRegistry, 拥有各自的超时时间
+//
+//	{registry}                            默认命名空间 DefaultNamespace, 与 GoRegistry 相同
+//	{registry}/{ns}                       命名空间 ns 的注册、心跳、注销和查询, 与 GoRegistry 相同
+//	{registry}/{ns}/v1/instances          命名空间 ns 的 JSON API, 见 apiPrefix
+//	GET {registry}/v1/namespaces          列出所有命名空间, 响应体为 namespacesResponse
+//	DELETE {registry}/v1/namespaces/{ns}  删除命名空间 ns, 见 RemoveNamespace
+//
+// 实例和服务发现使用 {registry}/{ns} 作为注册中心地址即可, 名称不能为 v1
+// 命名空间在第一次注册实例 (POST 请求) 时创建, 其他请求访问不存在的命名空间时返回 404, 避免拼错的命名空间被悄悄创建
+// 每个命名空间的注册中心都是通过 NewRegistry 新建的, 持久化、集群和主动健康检查需要通过 OnNamespace 为每个命名空间分别开启
+type NamespaceRegistry struct {
+	path    string                         // 注册路径
+	timeout time.Duration                  // 新建命名空间的超时时间
+	setup   func(ns string, r *GoRegistry) // 新建命名空间时执行, 见 OnNamespace
+
+	mu         sync.Mutex
+	namespaces map[string]*namespace
+}
+
+// namespace 一个命名空间
+type namespace struct {
+	r     *GoRegistry
+	setup sync.Once // 执行 OnNamespace 设置的函数, 执行完之前该命名空间的请求需要等待
+}
+
+// namespaceInfo 命名空间的信息
+type namespaceInfo struct {
+	Name      string `json:"name"`
+	Timeout   string `json:"timeout"`   // 超时时间, 例如 5m0s
+	Instances int    `json:"instances"` // 可用的实例数
+}
+
+// namespacesResponse 列出命名空间的响应体
+type namespacesResponse struct {
+	Namespaces []namespaceInfo `json:"namespaces"`
+}
+
+// OnNamespace 设置新建命名空间时执行的函数, 需要在处理请求之前设置
+// 例如为每个命名空间开启持久化 r.Persist(filepath.Join(dir, ns), interval), 或者设置集群 r.SetPeers(peer+"/"+ns)
+// f 执行时不持有 NamespaceRegistry 的锁, 只有命名空间 ns 的请求需要等待 f 返回, f 中不能再访问命名空间 ns
+// 持久化的命名空间在重启后不会自动创建, 需要在启动时通过 Namespace 预先创建, 才能在处理请求之前恢复实例
+func (n *NamespaceRegistry) OnNamespace(f func(ns string, r *GoRegistry)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.setup = f
+}
+
+// Namespace 返回命名空间 ns 的注册中心, 不存在时使用默认的超时时间创建, 并执行 OnNamespace 设置的函数
+// 可以在返回的注册中心上开启主动健康检查等功能
+func (n *NamespaceRegistry) Namespace(ns string) *GoRegistry {
+	n.mu.Lock()
+	e := n.namespaces[ns]
+	if e == nil {
+		e = &namespace{r: NewRegistry(n.timeout)}
+		n.namespaces[ns] = e
+	}
+	n.mu.Unlock()
+	return n.ready(ns, e)
+}
+
+// lookup 返回已经存在的命名空间 ns 的注册中心
+func (n *NamespaceRegistry) lookup(ns string) (*GoRegistry, bool) {
+	n.mu.Lock()
+	e, ok := n.namespaces[ns]
+	n.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return n.ready(ns, e), true
+}
+
+// ready 在锁之外执行 OnNamespace 设置的函数, 等待其返回后返回命名空间的注册中心
+// 设置函数可能需要访问网络, 例如 SetPeers, 执行时不能阻塞其他命名空间的请求
+func (n *NamespaceRegistry) ready(ns string, e *namespace) *GoRegistry {
+	e.setup.Do(func() {
+		n.mu.Lock()
+		setup := n.setup
+		n.mu.Unlock()
+		if setup != nil {
+			setup(ns, e.r)
+		}
+	})
+	return e.r
+}
+
+// RemoveNamespace 删除命名空间 ns 及其所有实例, 并关闭其注册中心, 见 GoRegistry.Close
+// 命名空间不存在时返回 ErrNamespaceNotFound; 持久化的文件不会被删除, 主动健康检查随其 ctx 结束
+func (n *NamespaceRegistry) RemoveNamespace(ns string) error {
+	n.mu.Lock()
+	e, ok := n.namespaces[ns]
+	delete(n.namespaces, ns)
+	n.mu.Unlock()
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+	return n.ready(ns, e).Close()
+}
+
+// SetTimeout 设置命名空间 ns 中实例的超时时间, 命名空间不存在时创建
+// 例如测试环境的实例频繁重启, 可以使用比生产环境更短的超时时间
+func (n *NamespaceRegistry) SetTimeout(ns string, timeout time.Duration) {
+	r := n.Namespace(ns)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timeout = timeout
+}
+
+// Namespaces 返回所有命名空间的名称, 已排序
+func (n *NamespaceRegistry) Namespaces() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	names := make([]string, 0, len(n.namespaces))
+	for ns := range n.namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeHTTP 根据路径中的命名空间将请求交给对应的 GoRegistry 处理
+func (n *NamespaceRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.EscapedPath()
+	if strings.HasPrefix(path, n.path) {
+		path = path[len(n.path):]
+	}
+	rest := strings.Trim(path, "/")
+	switch {
+	case rest == namespacesPath:
+		if req.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "rpc registry: 不支持的请求方法 "+req.Method)
+			return
+		}
+		writeJSON(w, http.StatusOK, namespacesResponse{Namespaces: n.list()})
+	case strings.HasPrefix(rest, namespacesPath+"/"):
+		n.serveNamespace(w, req, rest[len(namespacesPath)+1:])
+	case rest == "" || strings.HasPrefix(path, apiPrefix):
+		n.Namespace(DefaultNamespace).serve(w, req, path)
+	default:
+		// 第一段为命名空间, 之后的部分交给命名空间的注册中心
+		ns, sub := strings.TrimPrefix(path, "/"), ""
+		if i := strings.Index(ns, "/"); i >= 0 {
+			ns, sub = ns[:i], ns[i:]
+		}
+		name, err := url.PathUnescape(ns)
+		if err != nil || name == strings.Trim(apiPrefix, "/") {
+			writeError(w, http.StatusNotFound, "rpc registry: 未知的路径 "+req.URL.Path)
+			return
+		}
+		var r *GoRegistry
+		if req.Method == "POST" {
+			r = n.Namespace(name)
+		} else if r, _ = n.lookup(name); r == nil {
+			writeError(w, http.StatusNotFound, "rpc registry: 命名空间不存在 "+name)
+			return
+		}
+		r.serve(w, req, sub)
+	}
+}
+
+// serveNamespace 处理 {registry}/v1/namespaces/{ns} 的请求, ns 为未解码的命名空间
+func (n *NamespaceRegistry) serveNamespace(w http.ResponseWriter, req *http.Request, ns string) {
+	name, err := url.PathUnescape(ns)
+	if err != nil || name == "" || strings.Contains(ns, "/") {
+		writeError(w, http.StatusNotFound, "rpc registry: 未知的路径 "+req.URL.Path)
+		return
+	}
+	if req.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, "rpc registry: 不支持的请求方法 "+req.Method)
+		return
+	}
+	switch err = n.RemoveNamespace(name); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrNamespaceNotFound:
+		writeError(w, http.StatusNotFound, "rpc registry: 命名空间不存在 "+name)
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// list 返回所有命名空间的信息, 不会创建命名空间
+func (n *NamespaceRegistry) list() []namespaceInfo {
+	infos := make([]namespaceInfo, 0)
+	for _, ns := range n.Namespaces() {
+		r, ok := n.lookup(ns)
+		if !ok {
+			continue
+		}
+		alive, _, _, _ := r.snapshot()
+		r.mu.Lock()
+		timeout := r.timeout
+		r.mu.Unlock()
+		infos = append(infos, namespaceInfo{Name: ns, Timeout: timeout.String(), Instances: len(alive)})
+	}
+	return infos
+}
+
+// HandleHTTP 在 registryPath 及其子路径上处理请求
+func (n *NamespaceRegistry) HandleHTTP(registryPath string) {
+	n.path = strings.TrimSuffix(registryPath, "/")
+	http.Handle(n.path, n)
+	http.Handle(n.path+"/", n)
+	log.Println("rpc registry path: ", n.path)
+}
+
+// NewNamespaceRegistry 新建按命名空间隔离的注册中心, timeout 为新建命名空间的超时时间, 注册路径默认为 defaultPath
+func NewNamespaceRegistry(timeout time.Duration) *NamespaceRegistry {
+	return &NamespaceRegistry{
+		path:       defaultPath,
+		timeout:    timeout,
+		namespaces: make(map[string]*namespace),
+	}
+}
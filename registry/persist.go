@@ -0,0 +1,293 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 持久化文件, 位于 Persist 的目录下
+// 快照为所有实例的 JSON 数组, 日志为快照之后的变化, 每行一条 journalEntry
+const (
+	snapshotFile = "registry.snapshot"
+	journalFile  = "registry.journal"
+	// defaultSnapshotInterval 默认的快照间隔, 写入快照后清空日志
+	defaultSnapshotInterval = time.Minute
+)
+
+// journalEntry 日志中的一条记录, Item 不为 nil 时为注册或更新实例, 否则为删除实例 Addr
+type journalEntry struct {
+	Item *ServerItem `json:"item,omitempty"`
+	Addr string      `json:"addr,omitempty"`
+}
+
+// Persist 将实例列表持久化到目录 dir, 并从 dir 中已有的快照和日志恢复实例列表
+// 实例发生变化时立即追加到日志, 每隔 interval 写入一次快照并清空日志, interval 为 0 时使用 defaultSnapshotInterval
+// 恢复的实例重新开始计算超时时间, 注册中心重启后实例有一个完整的超时时间重新发送心跳, 已经下线的实例在超时后被删除
+// 需要在注册中心开始处理请求之前调用, 通过 Close 停止持久化, 持久化过程中写入日志或快照出错时由 Close 返回第一个错误
+func (r *GoRegistry) Persist(dir string, interval time.Duration) error {
+	if interval == 0 {
+		interval = defaultSnapshotInterval
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	items, err := loadState(dir)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if r.journal != nil {
+		r.mu.Unlock()
+		return errors.New("rpc registry: 已经开启持久化")
+	}
+	// 继续追加到已有的日志, 恢复的实例由接下来的快照写入, 写入快照后再清空日志
+	journal, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	info, err := journal.Stat()
+	if err != nil {
+		_ = journal.Close()
+		r.mu.Unlock()
+		return err
+	}
+	now := time.Now()
+	for _, item := range items {
+		item := item
+		item.start = now
+		r.servers[item.Addr] = &item
+	}
+	if len(items) > 0 {
+		r.bump()
+	}
+	r.dir = dir
+	r.journal, r.journalSize = journal, info.Size()
+	r.mu.Unlock()
+	if err = r.compact(); err != nil {
+		r.mu.Lock()
+		_ = r.journal.Close()
+		r.journal = nil
+		r.mu.Unlock()
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stop = make(chan struct{})
+	r.stopped = make(chan struct{})
+	go r.runSnapshot(interval, r.stop, r.stopped)
+	return nil
+}
+
+// stopPersist 停止持久化, 写入最后一次快照并关闭日志, 没有开启持久化时什么也不做
+func (r *GoRegistry) stopPersist() error {
+	r.mu.Lock()
+	stop, stopped := r.stop, r.stopped
+	r.stop = nil
+	r.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	<-stopped
+	err := r.compact()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.journal != nil {
+		if e := r.journal.Close(); err == nil {
+			err = e
+		}
+	}
+	r.journal = nil
+	if r.persistErr != nil {
+		err, r.persistErr = r.persistErr, nil
+	}
+	return err
+}
+
+// persistFailed 记录持久化过程中第一次出现的错误, 需要持有 r.mu
+func (r *GoRegistry) persistFailed(err error) {
+	if r.persistErr == nil {
+		r.persistErr = err
+	}
+}
+
+// runSnapshot 每隔 interval 写入一次快照, 直到 stop 关闭
+func (r *GoRegistry) runSnapshot(interval time.Duration, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if err := r.compact(); err != nil {
+			log.Println("rpc registry: 写入快照出错 ", err)
+			r.mu.Lock()
+			r.persistFailed(err)
+			r.mu.Unlock()
+		}
+	}
+}
+
+// compact 将实例列表写入快照, 然后从日志中删除快照已经包含的记录, 不能持有 r.mu
+// 只在持有 r.mu 时生成快照的内容并记下日志的长度, 写入快照和同步到磁盘时不阻塞注册和心跳
+// 先写入临时文件并同步到磁盘再重命名, 写入过程中退出或者断电不会损坏已有的快照
+// 重命名快照之后、截断日志之前退出时, 恢复时会在快照上重放一遍已经包含在快照中的日志, 结果不变
+func (r *GoRegistry) compact() error {
+	r.compacting.Lock()
+	defer r.compacting.Unlock()
+	r.mu.Lock()
+	items := make([]ServerItem, 0, len(r.servers))
+	for _, s := range r.servers {
+		if !r.expired(s) {
+			items = append(items, *s)
+		}
+	}
+	dir, offset := r.dir, r.journalSize
+	r.mu.Unlock()
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, snapshotFile+".tmp")
+	if err = writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+	syncDir(dir)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.truncateJournal(offset)
+}
+
+// truncateJournal 删除日志的前 offset 个字节, 保留生成快照之后追加的记录, 需要持有 r.mu
+// 与快照相同, 先写入临时文件再重命名替换日志, 然后重新打开日志继续追加
+func (r *GoRegistry) truncateJournal(offset int64) error {
+	if r.journal == nil {
+		return nil
+	}
+	name := filepath.Join(r.dir, journalFile)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	tail := data[offset:]
+	if err = writeFileSync(name+".tmp", tail); err != nil {
+		return err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	syncDir(r.dir)
+	_ = r.journal.Close()
+	r.journal = nil
+	journal, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r.journal, r.journalSize = journal, int64(len(tail))
+	return nil
+}
+
+// writeFileSync 将 data 写入文件 name 并同步到磁盘
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// syncDir 将目录 dir 同步到磁盘, 使重命名生效, 部分系统不支持同步目录, 因此忽略错误
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
+
+// record 将实例的变化追加到日志, item 为 nil 时表示删除实例 addr, 需要持有 r.mu
+// 日志不会逐条同步到磁盘, 只保证进程退出时不丢失: 断电时可能丢失最近写入的记录
+// 丢失的实例在下一次心跳时重新注册, 因此不为每次注册和心跳付出一次 fsync 的开销
+func (r *GoRegistry) record(addr string, item *ServerItem) {
+	if r.journal == nil {
+		return
+	}
+	data, _ := json.Marshal(journalEntry{Item: item, Addr: addr})
+	n, err := r.journal.Write(append(data, '\n'))
+	r.journalSize += int64(n)
+	if err != nil {
+		log.Println("rpc registry: 写入日志出错 ", err)
+		r.persistFailed(err)
+	}
+}
+
+// loadState 读取目录 dir 中的快照, 然后按顺序重放日志, 返回恢复的实例
+// 文件不存在时视为空, 日志最后一行不完整时忽略, 通常是写入过程中进程退出导致的
+func loadState(dir string) ([]ServerItem, error) {
+	servers := make(map[string]ServerItem)
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var items []ServerItem
+		if err = json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			servers[item.Addr] = item
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, journalFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer func() { _ = f.Close() }()
+		reader := bufio.NewReader(f)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			var entry journalEntry
+			if err = json.Unmarshal(line, &entry); err != nil {
+				return nil, err
+			}
+			if entry.Item != nil {
+				servers[entry.Item.Addr] = *entry.Item
+			} else {
+				delete(servers, entry.Addr)
+			}
+		}
+	}
+	items := make([]ServerItem, 0, len(servers))
+	for _, item := range servers {
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -1,88 +1,344 @@
 package registry
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"net/http"
+	"os"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// ServerItem 注册的实例及其元数据, 以 JSON 格式注册时包含所有字段, 以请求头注册时只包含地址和服务
 type ServerItem struct {
-	Addr  string    // 实例地址
-	start time.Time // 启动时间
+	Addr     string            `json:"addr"`               // 实例地址
+	Services []string          `json:"services,omitempty"` // 实例提供的服务, 已排序, 为空表示未知, 此时认为实例提供所有服务
+	Weight   int               `json:"weight,omitempty"`   // 权重, 供加权负载均衡使用, 0 表示未设置
+	Version  string            `json:"version,omitempty"`  // 实例的版本号, 例如 1.2.0
+	Zone     string            `json:"zone,omitempty"`     // 实例所在的可用区
+	Tags     map[string]string `json:"tags,omitempty"`     // 其他元数据, 例如 canary=true
+	start    time.Time         // 启动时间
+
+	failures  int  // 主动健康检查连续失败的次数
+	unhealthy bool // 主动健康检查判定实例不健康, 不健康的实例不会被返回
+}
+
+// sameMetadata 判断两个实例的元数据是否相同
+func (s *ServerItem) sameMetadata(o *ServerItem) bool {
+	a, b := *s, *o
+	a.start, b.start = time.Time{}, time.Time{}
+	a.failures, b.failures = 0, 0
+	a.unhealthy, b.unhealthy = false, false
+	return reflect.DeepEqual(a, b)
+}
+
+// hosts 判断实例是否提供服务 service
+func (s *ServerItem) hosts(service string) bool {
+	if len(s.Services) == 0 {
+		return true
+	}
+	i := sort.SearchStrings(s.Services, service)
+	return i < len(s.Services) && s.Services[i] == service
 }
 
 type GoRegistry struct {
-	timeout time.Duration          // 超时时间
-	mu      sync.Mutex             // 保护操作的完整性
-	servers map[string]*ServerItem // 实例列表
+	path     string                 // 注册路径, 见 HandleHTTP
+	timeout  time.Duration          // 超时时间
+	mu       sync.Mutex             // 保护操作的完整性
+	servers  map[string]*ServerItem // 实例列表
+	revision uint64                 // 实例列表的版本号, 每次变化时加 1
+	changed  chan struct{}          // 实例列表变化时关闭并替换为新的 channel, 用于唤醒 watch 请求
+
+	dir     string   // 持久化的目录, 见 Persist
+	journal *os.File // 持久化的日志, 为 nil 时未开启持久化
+	// journalSize 日志的长度, 写入快照后截断日志时, 保留生成快照之后追加的部分
+	journalSize int64
+	compacting  sync.Mutex    // 保证同一时刻只有一个 compact
+	stop        chan struct{} // 关闭时停止写入快照
+	stopped     chan struct{} // 停止写入快照后关闭
+	// persistErr 写入日志或快照时第一次出现的错误, 由 Close 返回
+	persistErr error
+
+	peers       []*peer        // 集群中的其他节点, 见 SetPeers
+	replicating sync.WaitGroup // 正在向其他节点转发的 goroutine
+}
+
+// bump 实例列表发生变化, 更新版本号并唤醒 watch 请求, 需要持有 r.mu
+func (r *GoRegistry) bump() {
+	r.revision++
+	close(r.changed)
+	r.changed = make(chan struct{})
 }
 
 // putServer 添加服务实例, 如果服务已存在则更新启动时间 start
-func (r *GoRegistry) putServer(addr string) {
+// replace 为 true 时使用 item 替换实例原有的元数据, 否则只在 item.Services 不为空时更新实例提供的服务
+func (r *GoRegistry) putServer(item ServerItem, replace bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	s := r.servers[addr]
+	item.Services = append([]string(nil), item.Services...)
+	sort.Strings(item.Services)
+	if len(item.Services) == 0 {
+		item.Services = nil
+	}
+	item.start = time.Now()
+	s := r.servers[item.Addr]
 	if s == nil {
 		// 服务不存在, 执行新增, 设置启动时间
-		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
+		r.servers[item.Addr] = &item
+		r.record(item.Addr, &item)
+		r.bump()
 		return
 	}
 	// 若服务已存在, 更新启动时间保活
-	s.start = time.Now()
+	s.start = item.start
+	if !replace {
+		if item.Services == nil {
+			return
+		}
+		services := item.Services
+		item = *s
+		item.Services = services
+	}
+	if !s.sameMetadata(&item) {
+		item.failures, item.unhealthy = s.failures, s.unhealthy
+		*s = item
+		r.record(s.Addr, s)
+		r.bump()
+	}
 }
 
 // aliveServers 返回可用的服务列表, 如果存在超时的服务则删除
 func (r *GoRegistry) aliveServers() []string {
+	alive, _, _, _ := r.snapshot()
+	return addrs(alive)
+}
+
+// addrs 返回实例的地址
+func addrs(items []ServerItem) []string {
+	addrs := make([]string, 0, len(items))
+	for _, s := range items {
+		addrs = append(addrs, s.Addr)
+	}
+	return addrs
+}
+
+// filter 返回提供服务 service 的实例, service 为空时返回所有实例
+func filter(items []ServerItem, service string) []ServerItem {
+	if service == "" {
+		return items
+	}
+	hosts := make([]ServerItem, 0, len(items))
+	for _, s := range items {
+		if s.hosts(service) {
+			hosts = append(hosts, s)
+		}
+	}
+	return hosts
+}
+
+// snapshot 返回可用的实例及实例列表的版本号, 实例按地址排序, 如果存在超时的服务则删除, 不返回不健康的实例
+// 同时返回实例列表变化时关闭的 channel, 以及最早超时的实例的超时时刻, 没有会超时的实例时为零值
+func (r *GoRegistry) snapshot() (alive []ServerItem, revision uint64, changed <-chan struct{}, nextExpiry time.Time) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
+	removed := false
 	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			// 未设置超时时间 或者 启动时间加上超时时间大与当前时刻, 表明服务未过期, 添加到活跃服务列表
-			alive = append(alive, addr)
+		if r.timeout == 0 {
+			if !s.unhealthy {
+				alive = append(alive, *s)
+			}
+			continue
+		}
+		expiry := s.start.Add(r.timeout)
+		if expiry.After(time.Now()) {
+			// 启动时间加上超时时间大与当前时刻, 表明服务未过期, 添加到活跃服务列表
+			if !s.unhealthy {
+				alive = append(alive, *s)
+			}
+			if nextExpiry.IsZero() || expiry.Before(nextExpiry) {
+				nextExpiry = expiry
+			}
 			continue
 		}
 		// 服务已超时, 进行删除
 		delete(r.servers, addr)
+		r.record(addr, nil)
+		removed = true
+	}
+	if removed {
+		r.bump()
+	}
+	sort.Slice(alive, func(i, j int) bool { return alive[i].Addr < alive[j].Addr })
+	return alive, r.revision, r.changed, nextExpiry
+}
+
+// watch 等待实例列表的版本号不等于 revision 后返回实例列表及其版本号
+// 超过 wait 或者 ctx 结束时返回当前的实例列表
+func (r *GoRegistry) watch(ctx context.Context, revision uint64, wait time.Duration) ([]ServerItem, uint64) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		alive, rev, changed, nextExpiry := r.snapshot()
+		if rev != revision {
+			return alive, rev
+		}
+		// 实例超时也会改变实例列表, 到达最早的超时时刻时重新检查
+		var expiry <-chan time.Time
+		if !nextExpiry.IsZero() {
+			expiry = time.After(time.Until(nextExpiry))
+		}
+		select {
+		case <-changed:
+		case <-expiry:
+		case <-deadline.C:
+			return alive, rev
+		case <-ctx.Done():
+			return alive, rev
+		}
 	}
-	sort.Strings(alive)
-	return alive
 }
 
 // ServeHTTP 运行在/_geerpc_/registry
+// GET 请求带有 X-Gorpc-Revision 时为 watch 请求, 等到实例列表的版本号与其不同, 或者超过 defaultWatchTimeout 后才返回
+// GET 请求的响应中 X-Gorpc-Servers 为服务列表, X-Gorpc-Revision 为服务列表的版本号
+// X-Gorpc-Services 为每个实例提供的服务, 格式为 addr=Service1|Service2,addr=Service1, 不包含服务未知的实例
+// GET 请求的参数 service 不为空时只返回提供该服务的实例, 服务未知的实例总是会被返回
+// GET 请求的 Accept 为 application/json 时, 响应体为包含实例元数据的 JSON, 格式为 registryResponse
+// POST 请求的 X-Gorpc-Servers 为实例地址, X-Gorpc-Services 为实例提供的服务, 以逗号分隔
+// POST 请求的 Content-Type 为 application/json 时, 请求体为 JSON 格式的 ServerItem, 可以携带实例的元数据
+// DELETE 请求注销 X-Gorpc-Servers 中的实例, 实例不存在时返回 404
+// 紧跟在注册路径之后的 /v1/ 为 JSON API, 见 apiPrefix
+// 设置了 SetPeers 时, 注册、心跳和注销会转发给集群中的其他节点
+// 开启主动健康检查后, 被判定为不健康的实例不会出现在 GET 请求的结果中, 见 StartHealthCheck
 func (r *GoRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.EscapedPath()
+	if strings.HasPrefix(path, r.path) {
+		path = path[len(r.path):]
+	}
+	r.serve(w, req, path)
+}
+
+// serve 处理请求, path 为注册路径之后未解码的路径
+func (r *GoRegistry) serve(w http.ResponseWriter, req *http.Request, path string) {
+	if strings.HasPrefix(path, apiPrefix) {
+		r.serveAPI(w, req, path[len(apiPrefix):])
+		return
+	}
 	switch req.Method {
 	case "GET":
-		w.Header().Set("X-Gorpc-Servers", strings.Join(r.aliveServers(), ","))
+		var alive []ServerItem
+		var revision uint64
+		if v := req.Header.Get("X-Gorpc-Revision"); v != "" {
+			watched, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			alive, revision = r.watch(req.Context(), watched, defaultWatchTimeout)
+		} else {
+			alive, revision, _, _ = r.snapshot()
+		}
+		alive = filter(alive, req.URL.Query().Get("service"))
+		w.Header().Set("X-Gorpc-Servers", strings.Join(addrs(alive), ","))
+		w.Header().Set("X-Gorpc-Services", formatServices(alive))
+		w.Header().Set("X-Gorpc-Revision", strconv.FormatUint(revision, 10))
+		if strings.Contains(req.Header.Get("Accept"), jsonContentType) {
+			w.Header().Set("Content-Type", jsonContentType)
+			_ = json.NewEncoder(w).Encode(registryResponse{Revision: revision, Servers: alive})
+		}
 	case "POST":
+		if strings.HasPrefix(req.Header.Get("Content-Type"), jsonContentType) {
+			var item ServerItem
+			if err := json.NewDecoder(req.Body).Decode(&item); err != nil || item.Addr == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.putServer(item, true)
+			r.replicateServer(req, item.Addr)
+			return
+		}
 		addr := req.Header.Get("X-Gorpc-Servers")
 		if addr == "" {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		r.putServer(ServerItem{Addr: addr, Services: splitList(req.Header.Get("X-Gorpc-Services"))}, false)
+		r.replicateServer(req, addr)
+	case "DELETE":
+		addr := req.Header.Get("X-Gorpc-Servers")
+		if addr == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// 即使本节点没有该实例也转发, 其他节点可能有
+		r.replicate(req, addr, nil)
+		if !r.removeServer(addr) {
+			w.WriteHeader(http.StatusNotFound)
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// jsonContentType JSON 格式的请求体和响应体的 Content-Type
+const jsonContentType = "application/json"
+
+// registryResponse JSON 格式的 GET 请求的响应体
+type registryResponse struct {
+	Revision uint64       `json:"revision"`
+	Servers  []ServerItem `json:"servers"`
+}
+
+// formatServices 将每个实例提供的服务格式化为 addr=Service1|Service2,addr=Service1
+func formatServices(items []ServerItem) string {
+	parts := make([]string, 0, len(items))
+	for _, s := range items {
+		if len(s.Services) > 0 {
+			parts = append(parts, s.Addr+"="+strings.Join(s.Services, "|"))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitList 解析以逗号分隔的列表, 忽略空白的元素
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// HandleHTTP 在 registryPath 及其 JSON API 路径上处理请求
+// 不使用 HandleHTTP 时注册路径为 defaultPath, 挂载到其他路径时需要配合 http.StripPrefix 使用
 func (r *GoRegistry) HandleHTTP(registryPath string) {
+	r.path = strings.TrimSuffix(registryPath, "/")
 	http.Handle(registryPath, r)
+	http.Handle(r.path+apiPrefix, r)
 	log.Println("rpc registry path: ", registryPath)
 }
 
 const (
 	defaultPath    = "/_gorpc_/registry" // 注册路径
 	defaultTimeout = 5 * time.Minute     // 默认超时时间为5min
+	// watch 请求最长的等待时间, 超过后即使实例列表没有变化也返回
+	defaultWatchTimeout = 30 * time.Second
 )
 
 func NewRegistry(timeout time.Duration) *GoRegistry {
 	return &GoRegistry{
-		timeout: timeout,
-		servers: make(map[string]*ServerItem),
+		path:     defaultPath,
+		timeout:  timeout,
+		servers:  make(map[string]*ServerItem),
+		revision: 1,
+		changed:  make(chan struct{}),
 	}
 }
 
@@ -91,34 +347,3 @@ var DefaultGoRegistry = NewRegistry(defaultTimeout)
 func HandleHTTP() {
 	DefaultGoRegistry.HandleHTTP(defaultPath)
 }
-
-// Heartbeat 发送心跳消息保活
-func Heartbeat(registry, addr string, duration time.Duration) {
-	if duration == 0 {
-		// 确保在被移除之前有足够时间发送心跳
-		duration = time.Second // defaultTimeout - time.Duration(1)*time.Minute
-	}
-	// 利用定时器定时发送心跳
-	go func() {
-		var err error
-		err = sendHeartbeat(registry, addr)
-		t := time.NewTicker(duration)
-		defer t.Stop()
-		for err != nil {
-			<-t.C
-			err = sendHeartbeat(registry, addr)
-		}
-	}()
-}
-
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, " 发送心跳消息到注册中心 ", registry)
-	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
-	req.Header.Set("X-Gorpc-Servers", addr)
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server: 发送心跳消息出错 ", err)
-		return err
-	}
-	return nil
-}
@@ -0,0 +1,466 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gorpc/codec"
+	"gorpc/option"
+	"gorpc/server"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestGoRegistry_API(t *testing.T) {
+	ts := httptest.NewServer(NewRegistry(time.Minute))
+	defer ts.Close()
+	api := ts.URL + defaultPath + "/v1/instances"
+	do := func(method, url string, body interface{}) *http.Response {
+		var buf bytes.Buffer
+		if body != nil {
+			_ = json.NewEncoder(&buf).Encode(body)
+		}
+		req, _ := http.NewRequest(method, url, &buf)
+		resp, err := http.DefaultClient.Do(req)
+		_assert(err == nil, "request failed: %v", err)
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		defer func() { _ = resp.Body.Close() }()
+		_ = json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	status := func(method, url string, body interface{}) int {
+		resp := do(method, url, body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	code := status("POST", api, ServerItem{Addr: "tcp@a", Services: []string{"Foo"}, Weight: 3})
+	_assert(code == http.StatusOK, "expect register to succeed, but got %d", code)
+	_ = status("POST", api, ServerItem{Addr: "tcp@b", Services: []string{"Bar"}})
+
+	var list registryResponse
+	decode(do("GET", api+"?service=Foo", nil), &list)
+	_assert(len(list.Servers) == 1 && list.Servers[0].Addr == "tcp@a" && list.Servers[0].Weight == 3, "unexpected list %+v", list)
+
+	instance := api + "/" + url.PathEscape("tcp@a")
+	var item ServerItem
+	decode(do("GET", instance, nil), &item)
+	_assert(item.Addr == "tcp@a" && item.Services[0] == "Foo", "unexpected instance %+v", item)
+
+	code = status("PUT", instance+"/heartbeat", nil)
+	_assert(code == http.StatusNoContent, "expect heartbeat to succeed, but got %d", code)
+	code = status("DELETE", instance, nil)
+	_assert(code == http.StatusNoContent, "expect deregister to succeed, but got %d", code)
+	code = status("PUT", instance+"/heartbeat", nil)
+	_assert(code == http.StatusNotFound, "expect heartbeat of a removed instance to fail, but got %d", code)
+
+	// 旧的请求头协议仍然可用
+	resp, _ := http.Get(ts.URL + defaultPath)
+	_ = resp.Body.Close()
+	_assert(resp.Header.Get("X-Gorpc-Servers") == "tcp@b", "unexpected servers %s", resp.Header.Get("X-Gorpc-Servers"))
+	_assert(fmt.Sprint(list.Revision+1) == resp.Header.Get("X-Gorpc-Revision"), "expect deregister to bump the revision")
+}
+
+func TestGoRegistry_APIPath(t *testing.T) {
+	// 注册路径中包含 /v1/, 实例地址中包含 /
+	r := NewRegistry(time.Minute)
+	r.HandleHTTP("/api/v1/registry")
+	ts := httptest.NewServer(http.DefaultServeMux)
+	defer ts.Close()
+	base := ts.URL + "/api/v1/registry"
+	addr := "unix@/tmp/gorpc.sock"
+	status := func(method, url string, header string) int {
+		req, _ := http.NewRequest(method, url, nil)
+		if header != "" {
+			req.Header.Set("X-Gorpc-Servers", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		_assert(err == nil, "request failed: %v", err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	code := status("POST", base, addr)
+	_assert(code == http.StatusOK, "expect the header API to register, but got %d", code)
+	instance := base + "/v1/instances/" + url.PathEscape(addr)
+	code = status("GET", instance, "")
+	_assert(code == http.StatusOK, "expect the escaped address to be found, but got %d", code)
+	code = status("DELETE", instance, "")
+	_assert(code == http.StatusNoContent, "expect the escaped address to be removed, but got %d", code)
+	_assert(len(r.aliveServers()) == 0, "expect no instances, but got %v", r.aliveServers())
+}
+
+func TestHeartbeat_Stop(t *testing.T) {
+	r := NewRegistry(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	h := Heartbeat(ts.URL, "tcp@a", 10*time.Millisecond, "Foo")
+	for start := time.Now(); len(r.aliveServers()) == 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	_assert(len(r.aliveServers()) == 1, "expect the heartbeat to register the instance")
+	_assert(h.Stop() == nil, "expect deregister to succeed")
+	_assert(len(r.aliveServers()) == 0, "expect the instance to be removed immediately")
+	time.Sleep(30 * time.Millisecond)
+	_assert(len(r.aliveServers()) == 0, "expect no heartbeat after Stop")
+}
+
+func TestHeartbeatAgent(t *testing.T) {
+	r := NewRegistry(time.Minute)
+	live := httptest.NewServer(r)
+	defer live.Close()
+	dead := httptest.NewServer(NewRegistry(time.Minute))
+	dead.Close()
+
+	a := NewHeartbeatAgent([]string{live.URL, dead.URL}, ServerItem{Addr: "tcp@a"}, 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	status := a.Status()
+	_assert(status[0].LastError == nil && !status[0].LastSuccess.IsZero(), "expect the live registry to succeed, but got %+v", status[0])
+	_assert(status[1].LastError != nil && status[1].Failures > 1, "expect retries with backoff on the dead registry, but got %+v", status[1])
+	_assert(len(r.aliveServers()) == 1, "expect the instance to be registered")
+
+	cancel()
+	err := <-done
+	_assert(err != nil, "expect the dead registry to fail deregistration")
+	_assert(len(r.aliveServers()) == 0, "expect the instance to be deregistered on cancel")
+}
+
+func TestGoRegistry_HealthCheck(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	s := server.NewServer()
+	go s.Accept(l)
+	defer func() { _ = l.Close() }()
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	// 接收连接但从不回复, 模拟卡死的实例
+	blackhole, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = blackhole.Close() }()
+	go func() {
+		for {
+			conn, err := blackhole.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+	// 没有内置健康检查服务的旧版本实例
+	legacy, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = legacy.Close() }()
+	go func() {
+		for {
+			conn, err := legacy.Accept()
+			if err != nil {
+				return
+			}
+			go serveWithoutHealth(conn)
+		}
+	}()
+
+	healthy, unreachable := "tcp@"+l.Addr().String(), "tcp@"+dead.Addr().String()
+	wedged, old := "tcp@"+blackhole.Addr().String(), "tcp@"+legacy.Addr().String()
+	r := NewRegistry(time.Minute)
+	for _, addr := range []string{healthy, unreachable, wedged, old} {
+		r.putServer(ServerItem{Addr: addr}, false)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.StartHealthCheck(ctx, HealthCheckPolicy{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond, UnhealthyThreshold: 2})
+	time.Sleep(200 * time.Millisecond)
+	alive := r.aliveServers()
+	expected := []string{healthy, old}
+	sort.Strings(expected)
+	_assert(fmt.Sprint(alive) == fmt.Sprint(expected), "expect the unreachable and wedged instances to be excluded, but got %v", alive)
+
+	// 查询单个实例时返回健康状态
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", defaultPath+"/v1/instances/"+url.PathEscape(wedged), nil))
+	var instance instanceResponse
+	_ = json.NewDecoder(w.Body).Decode(&instance)
+	_assert(instance.Addr == wedged && !instance.Healthy, "expect the wedged instance to be reported unhealthy, but got %+v", instance)
+
+	// 实例不再提供服务, 之后恢复
+	s.SetServingStatus("", server.NotServing)
+	time.Sleep(100 * time.Millisecond)
+	_assert(len(r.aliveServers()) == 1, "expect the NOT_SERVING instance to be excluded")
+	s.SetServingStatus("", server.Serving)
+	time.Sleep(100 * time.Millisecond)
+	_assert(len(r.aliveServers()) == 2, "expect the instance to recover")
+}
+
+// serveWithoutHealth 读取请求并回复找不到服务的错误, 与没有内置健康检查服务的 Server 相同
+func serveWithoutHealth(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	var opt option.Option
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
+		return
+	}
+	// 与 Server.ServeConn 相同, 拼接 json.Decoder 多读取的数据并跳过 Option 之后的换行符
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), conn))
+	if b, err := r.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = r.Discard(1)
+	}
+	cc := codec.NewGobCodec(struct {
+		io.Reader
+		io.WriteCloser
+	}{r, conn})
+	for {
+		var h codec.Header
+		if cc.ReadHeader(&h) != nil || cc.ReadBody(nil) != nil {
+			return
+		}
+		if h.IsHeartbeat() {
+			continue
+		}
+		h.Error = "rpc server: 找不到服务 " + strings.TrimSuffix(h.ServiceMethod, ".Check")
+		_ = cc.Write(&h, struct{}{})
+	}
+}
+
+func TestGoRegistry_Persist(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRegistry(time.Minute)
+	_assert(r.Persist(dir, time.Hour) == nil, "expect Persist to succeed")
+	r.putServer(ServerItem{Addr: "tcp@a", Services: []string{"Foo"}, Weight: 3}, true)
+	r.putServer(ServerItem{Addr: "tcp@b"}, false)
+	r.putServer(ServerItem{Addr: "tcp@c"}, false)
+	_ = r.removeServer("tcp@c")
+
+	// 模拟进程退出: 不调用 Close, 只能从日志恢复, 并忽略写了一半的最后一行
+	_ = r.journal.Close()
+	f, _ := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString(`{"item":{"addr":"tcp@d"`)
+	_ = f.Close()
+	restored := NewRegistry(time.Minute)
+	_assert(restored.Persist(dir, time.Hour) == nil, "expect Persist to restore from the journal")
+	alive, _, _, _ := restored.snapshot()
+	_assert(len(alive) == 2 && alive[0].Addr == "tcp@a" && alive[0].Weight == 3 && alive[1].Addr == "tcp@b",
+		"unexpected restored servers %+v", alive)
+	_assert(!alive[0].start.IsZero(), "expect the TTL to be rebuilt on load")
+
+	// Close 写入快照后从快照恢复
+	_ = restored.removeServer("tcp@b")
+	_assert(restored.Close() == nil, "expect Close to succeed")
+	restored = NewRegistry(time.Minute)
+	_assert(restored.Persist(dir, time.Hour) == nil, "expect Persist to restore from the snapshot")
+	defer func() { _ = restored.Close() }()
+	servers := restored.aliveServers()
+	_assert(len(servers) == 1 && servers[0] == "tcp@a", "unexpected restored servers %v", servers)
+
+	// 截断日志时保留生成快照之后追加的记录
+	restored.mu.Lock()
+	offset := restored.journalSize
+	restored.mu.Unlock()
+	restored.putServer(ServerItem{Addr: "tcp@f"}, false)
+	restored.mu.Lock()
+	_assert(restored.truncateJournal(offset) == nil, "expect truncateJournal to succeed")
+	restored.mu.Unlock()
+	items, err := loadState(dir)
+	_assert(err == nil && len(items) == 2, "expect the entry appended after the snapshot to survive, but got %+v %v", items, err)
+
+	// 写入日志出错时由 Close 返回
+	broken := NewRegistry(time.Minute)
+	_assert(broken.Persist(t.TempDir(), time.Hour) == nil, "expect Persist to succeed")
+	_ = broken.journal.Close()
+	broken.putServer(ServerItem{Addr: "tcp@e"}, false)
+	_assert(broken.Close() != nil, "expect Close to report the journal error")
+}
+
+func TestGoRegistry_Cluster(t *testing.T) {
+	var nodes []*GoRegistry
+	var urls []string
+	for i := 0; i < 3; i++ {
+		r := NewRegistry(time.Minute)
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+		nodes = append(nodes, r)
+		urls = append(urls, ts.URL+defaultPath)
+	}
+	for i, r := range nodes {
+		var peers []string
+		for j, url := range urls {
+			if j != i {
+				peers = append(peers, url)
+			}
+		}
+		r.SetPeers(peers...)
+		defer func(r *GoRegistry) { _ = r.Close() }(r)
+	}
+	waitFor := func(cond func() bool) bool {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+			if cond() {
+				return true
+			}
+		}
+		return false
+	}
+	replicated := func(n int) func() bool {
+		return func() bool {
+			for _, r := range nodes {
+				if len(r.aliveServers()) != n {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	h := HeartbeatItem(urls[0], ServerItem{Addr: "tcp@a", Weight: 3}, time.Minute)
+	_assert(waitFor(replicated(1)), "expect the registration to be replicated to all nodes")
+	item, _ := nodes[2].getServer("tcp@a")
+	_assert(item.Weight == 3, "expect the metadata to be replicated, but got %+v", item)
+
+	// 新加入集群的节点从其他节点同步实例
+	joined := NewRegistry(time.Minute)
+	joined.SetPeers(urls[1])
+	_assert(len(joined.aliveServers()) == 1, "expect the new node to sync from its peers")
+	_ = joined.Close()
+
+	_ = h.Stop()
+	_assert(waitFor(replicated(0)), "expect the deregistration to be replicated to all nodes")
+}
+
+func TestGoRegistry_ClusterHeartbeat(t *testing.T) {
+	a, b := NewRegistry(100*time.Millisecond), NewRegistry(100*time.Millisecond)
+	tsA, tsB := httptest.NewServer(a), httptest.NewServer(b)
+	defer tsA.Close()
+	defer tsB.Close()
+	a.SetPeers(tsB.URL + defaultPath)
+	b.SetPeers(tsA.URL + defaultPath)
+	defer func() { _ = a.Close() }()
+	defer func() { _ = b.Close() }()
+
+	// 只通过 JSON API 的 PUT 心跳保活
+	api := tsA.URL + defaultPath + "/v1/instances"
+	body, _ := json.Marshal(ServerItem{Addr: "tcp@x"})
+	resp, err := http.Post(api, jsonContentType, bytes.NewReader(body))
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "expect register to succeed")
+	_ = resp.Body.Close()
+	heartbeat := api + "/" + url.PathEscape("tcp@x") + "/heartbeat"
+	for start := time.Now(); time.Since(start) < 300*time.Millisecond; time.Sleep(20 * time.Millisecond) {
+		req, _ := http.NewRequest("PUT", heartbeat, nil)
+		resp, err = http.DefaultClient.Do(req)
+		_assert(err == nil && resp.StatusCode == http.StatusNoContent, "expect heartbeat to succeed")
+		_ = resp.Body.Close()
+	}
+	_assert(fmt.Sprint(b.aliveServers()) == "[tcp@x]", "expect the heartbeat to be replicated to the peer, but got %v", b.aliveServers())
+}
+
+func TestNamespaceRegistry(t *testing.T) {
+	n := NewNamespaceRegistry(time.Minute)
+	var created []string
+	n.OnNamespace(func(ns string, r *GoRegistry) { created = append(created, ns) })
+	n.SetTimeout("staging", 50*time.Millisecond)
+	ts := httptest.NewServer(n)
+	defer ts.Close()
+	base := ts.URL + defaultPath
+	register := func(url, addr string) {
+		_assert(sendHeartbeat(context.Background(), url, ServerItem{Addr: addr}, time.Second) == nil, "expect %s to register", addr)
+	}
+	servers := func(url string) string {
+		resp, err := http.Get(url)
+		_assert(err == nil, "request failed: %v", err)
+		_ = resp.Body.Close()
+		return resp.Header.Get("X-Gorpc-Servers")
+	}
+
+	register(base+"/staging", "tcp@a")
+	register(base+"/prod", "tcp@b")
+	register(base, "tcp@c")
+	_assert(servers(base+"/staging") == "tcp@a", "expect staging to be isolated, but got %s", servers(base+"/staging"))
+	_assert(servers(base+"/prod") == "tcp@b", "expect prod to be isolated, but got %s", servers(base+"/prod"))
+	_assert(servers(base) == "tcp@c", "expect the default namespace, but got %s", servers(base))
+
+	var list registryResponse
+	resp, _ := http.Get(base + "/prod/v1/instances")
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	_ = resp.Body.Close()
+	_assert(len(list.Servers) == 1 && list.Servers[0].Addr == "tcp@b", "unexpected prod instances %+v", list)
+
+	// staging 的超时时间更短
+	time.Sleep(100 * time.Millisecond)
+	var namespaces namespacesResponse
+	resp, _ = http.Get(base + "/v1/namespaces")
+	_ = json.NewDecoder(resp.Body).Decode(&namespaces)
+	_ = resp.Body.Close()
+	_assert(len(namespaces.Namespaces) == 3, "expect 3 namespaces, but got %+v", namespaces)
+	staging := namespaces.Namespaces[2]
+	_assert(staging.Name == "staging" && staging.Instances == 0 && staging.Timeout == "50ms", "unexpected staging %+v", staging)
+	_assert(namespaces.Namespaces[1].Instances == 1, "expect prod to keep its instance, but got %+v", namespaces.Namespaces[1])
+	_assert(fmt.Sprint(created) == "[staging prod default]", "expect the setup hook to run for each namespace, but got %v", created)
+
+	// 只有注册会创建命名空间
+	resp, _ = http.Get(base + "/prdo")
+	_ = resp.Body.Close()
+	_assert(resp.StatusCode == http.StatusNotFound, "expect an unknown namespace to return 404, but got %d", resp.StatusCode)
+	_assert(len(n.Namespaces()) == 3, "expect GET not to create a namespace, but got %v", n.Namespaces())
+
+	req, _ := http.NewRequest("DELETE", base+"/v1/namespaces/prod", nil)
+	resp, _ = http.DefaultClient.Do(req)
+	_ = resp.Body.Close()
+	_assert(resp.StatusCode == http.StatusNoContent, "expect prod to be removed, but got %d", resp.StatusCode)
+	_assert(n.RemoveNamespace("prod") == ErrNamespaceNotFound, "expect prod to be removed already")
+	resp, _ = http.Get(base + "/prod")
+	_ = resp.Body.Close()
+	_assert(resp.StatusCode == http.StatusNotFound, "expect a removed namespace to return 404, but got %d", resp.StatusCode)
+}
+
+func TestNamespaceRegistry_Setup(t *testing.T) {
+	n := NewNamespaceRegistry(time.Minute)
+	release := make(chan struct{})
+	n.OnNamespace(func(ns string, r *GoRegistry) {
+		if ns == "slow" {
+			<-release
+		}
+	})
+	go n.Namespace("slow")
+	time.Sleep(20 * time.Millisecond)
+
+	// 其他命名空间不等待 slow 的设置函数
+	done := make(chan struct{})
+	go func() {
+		n.Namespace("fast")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expect other namespaces not to wait for the setup of slow")
+	}
+
+	// 同一个命名空间的请求等待设置函数返回
+	got := make(chan *GoRegistry, 1)
+	go func() { got <- n.Namespace("slow") }()
+	select {
+	case <-got:
+		t.Fatal("expect slow to wait for its setup")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	_assert(<-got != nil, "expect slow to be ready after its setup")
+}
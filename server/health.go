@@ -0,0 +1,78 @@
+package server
+
+import "errors"
+
+// HealthStatus 服务的健康状态
+type HealthStatus string
+
+const (
+	Serving    HealthStatus = "SERVING"     // 可以正常提供服务
+	NotServing HealthStatus = "NOT_SERVING" // 暂时不能提供服务, 例如正在关闭或者依赖不可用
+)
+
+// HealthCheckMethod 内置的健康检查方法, 每个 Server 都会提供, 供注册中心、负载均衡和命令行工具使用
+const HealthCheckMethod = "_gorpc.Health.Check"
+
+// healthServiceName 内置的健康检查服务名, 不出现在 Services 的返回值中
+// 没有使用 Health 作为服务名: 服务名来自类型名, 用户已有的 Health 服务会与之冲突而注册失败
+// _gorpc. 前缀不是合法的类型名, 作为框架保留的服务名, 不会与任何用户注册的服务冲突
+const healthServiceName = "_gorpc.Health"
+
+// HealthCheckRequest 内置的健康检查方法的参数
+type HealthCheckRequest struct {
+	Service string // 检查的服务名, 为空表示检查整个 Server
+}
+
+// HealthCheckResponse 内置的健康检查方法的返回值
+type HealthCheckResponse struct {
+	Status HealthStatus
+}
+
+// Health 内置的健康检查服务, 由 NewServer 以 healthServiceName 为服务名自动注册
+type Health struct {
+	s *Server
+}
+
+// Check 返回 Server 或者服务 req.Service 的健康状态
+// Server 开始关闭后总是返回 NotServing; 服务没有通过 SetServingStatus 设置状态时, 已注册的服务为 Serving
+// 服务的状态为 Serving 但整个 Server 的状态为 NotServing 时返回 NotServing
+func (h *Health) Check(req HealthCheckRequest, resp *HealthCheckResponse) error {
+	status, err := h.s.servingStatus(req.Service)
+	if err != nil {
+		return err
+	}
+	resp.Status = status
+	return nil
+}
+
+// SetServingStatus 设置服务 service 的健康状态, service 为空时设置整个 Server 的健康状态
+// 例如依赖的数据库不可用时设置为 NotServing, 让注册中心和负载均衡暂时摘除实例
+func (s *Server) SetServingStatus(service string, status HealthStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.health == nil {
+		s.health = make(map[string]HealthStatus)
+	}
+	s.health[service] = status
+}
+
+// servingStatus 返回服务 service 的健康状态, service 为空时返回整个 Server 的健康状态
+func (s *Server) servingStatus(service string) (HealthStatus, error) {
+	if service != "" && service != healthServiceName {
+		if _, ok := s.serviceMap.Load(service); !ok {
+			return "", errors.New("rpc server: 找不到服务 " + service)
+		}
+	}
+	if s.shuttingDown() {
+		return NotServing, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.health[""]; ok && status != Serving {
+		return status, nil
+	}
+	if status, ok := s.health[service]; ok {
+		return status, nil
+	}
+	return Serving, nil
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,8 +11,10 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gorpc/codec"
@@ -23,6 +27,129 @@ import (
 // Server 表示一个RPC服务器
 type Server struct {
 	serviceMap sync.Map
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{} // Accept 中的 Listener, Shutdown 时关闭
+	conns      map[*serverConn]struct{}  // 正在处理的连接, Shutdown 时等待其请求处理完后关闭
+	onShutdown []func()                  // Shutdown 时执行的函数
+	inShutdown int32                     // 是否正在关闭, 原子操作
+	health     map[string]HealthStatus   // SetServingStatus 设置的健康状态, 空字符串表示整个 Server
+}
+
+// serverConn 正在处理的连接
+type serverConn struct {
+	c       codec.Codec
+	pending int64 // 正在处理的请求数, 原子操作
+}
+
+// shutdownPollInterval Shutdown 检查空闲连接的间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+// shuttingDown 判断 Server 是否正在关闭
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+// RegisterOnShutdown 注册 Shutdown 时执行的函数, 例如从注册中心注销实例
+// 函数在 Shutdown 关闭 Listener 之前同时开始执行, Shutdown 返回前等待其结束, 最多等到 ctx 结束
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Shutdown 优雅地关闭 Server
+// 开始关闭后内置的健康检查总是返回 NotServing, 首先执行 RegisterOnShutdown 注册的函数, 然后关闭所有 Listener 不再接收新的连接,
+// 再等待每个连接上正在处理的请求结束后关闭连接, 并等待注册的函数执行完; ctx 结束时直接关闭剩余的连接, 返回 ctx 的错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	hooks := make(chan struct{})
+	var wg sync.WaitGroup
+	s.mu.Lock()
+	for _, f := range s.onShutdown {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			f()
+		}(f)
+	}
+	for lis := range s.listeners {
+		_ = lis.Close()
+		delete(s.listeners, lis)
+	}
+	s.mu.Unlock()
+	go func() {
+		wg.Wait()
+		close(hooks)
+	}()
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		if s.closeIdleConns(false) {
+			select {
+			case <-hooks:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			s.closeIdleConns(true)
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// closeIdleConns 关闭没有正在处理的请求的连接, force 为 true 时关闭所有连接, 所有连接都已关闭时返回 true
+func (s *Server) closeIdleConns(force bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sc := range s.conns {
+		if force || atomic.LoadInt64(&sc.pending) == 0 {
+			_ = sc.c.Close()
+			delete(s.conns, sc)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// trackListener 记录 Accept 中的 Listener, Server 正在关闭时返回 false
+func (s *Server) trackListener(lis net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if !add {
+		delete(s.listeners, lis)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	s.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn 记录正在处理的连接, Server 正在关闭时返回 false
+func (s *Server) trackConn(sc *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	if !add {
+		delete(s.conns, sc)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	s.conns[sc] = struct{}{}
+	return true
 }
 
 // Register 服务注册
@@ -34,6 +161,19 @@ func (s *Server) Register(rcvr interface{}) error {
 	return nil
 }
 
+// Services 返回已注册的所有服务名, 已排序, 不包含内置的健康检查服务
+func (s *Server) Services() []string {
+	var names []string
+	s.serviceMap.Range(func(name, _ interface{}) bool {
+		if name != healthServiceName {
+			names = append(names, name.(string))
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
 // findService 通过服务名找到对应的方法
 func (s *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	// serviceMethod的组成为 Service.Method
@@ -57,13 +197,20 @@ func (s *Server) findService(serviceMethod string) (svc *service, mtype *methodT
 	return
 }
 
-// Accept 接收 net.Listener 中的连接
+// Accept 接收 net.Listener 中的连接, 直到 Listener 出错或者 Server 关闭
 func (s *Server) Accept(lis net.Listener) {
+	if !s.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer s.trackListener(lis, false)
 	// for 循环等待 socket 连接建立, 并开启 ServerConn 子协程处理
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Fatalln("rpc server: 接收连接出错 err: ", err)
+			if !s.shuttingDown() {
+				log.Println("rpc server: 接收连接出错 err: ", err)
+			}
 			return
 		}
 		go s.ServeConn(conn)
@@ -77,22 +224,35 @@ func (s *Server) ServeConn(conn io.ReadWriteCloser) {
 	}()
 	var opt option.Option
 	// 首先使用 json.NewDecoder 反序列化得到 Option 实例
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Fatalln("rpc server: 反序列化Option出错 err: ", err)
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
+		log.Println("rpc server: 反序列化Option出错 err: ", err)
 		return
 	}
 	// 检查 MagicNumber 和 CodeType 的值是否正确,
 	// 根据 CodeType 得到对应的消息编解码器
 	if opt.MagicNumber != option.MagicNumber {
-		log.Fatalf("rpc server: 非法魔数 %x\n", opt.MagicNumber)
+		log.Printf("rpc server: 非法魔数 %x\n", opt.MagicNumber)
 		return
 	}
 	f := codec.NewCodecFuncMap[opt.CodecType]
 	if f == nil {
-		log.Fatalf("rpc server: 非法CodecType %s\n", opt.CodecType)
+		log.Printf("rpc server: 非法CodecType %s\n", opt.CodecType)
 		return
 	}
-	s.serveCodec(f(conn), &opt)
+	// json.Decoder 可能多读取了 Option 之后的数据, 需要拼接回连接中交给 Codec
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), conn))
+	// json.Encoder 会在 Option 之后写入一个换行符, 需要跳过
+	if b, err := r.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = r.Discard(1)
+	}
+	s.serveCodec(f(&optionConn{Reader: r, WriteCloser: conn}), &opt)
+}
+
+// optionConn 读取时先返回 json.Decoder 缓冲区中剩余的数据, 再从连接中读取
+type optionConn struct {
+	io.Reader
+	io.WriteCloser
 }
 
 // invalidRequest 当响应argv出错时设置
@@ -112,30 +272,80 @@ type request struct {
 // 2.处理请求是并发的, 但是回复请求的报文必须是逐个发送的, 并发容易导致多个回复报文交织在一起, 客户端无法解析, 在这里使用锁(sending)保证
 // 3.尽力而为, 只有在 header 解析失败时, 才终止循环
 func (s *Server) serveCodec(c codec.Codec, opt *option.Option) {
+	sc := &serverConn{c: c}
+	if !s.trackConn(sc, true) {
+		_ = c.Close()
+		return
+	}
+	defer s.trackConn(sc, false)
 	// 加锁确保发送一条完整的消息
 	sending := new(sync.Mutex)
 	wg := new(sync.WaitGroup)
+	// 最近一次收到客户端消息的时间, 用于心跳检测
+	lastRecv := time.Now().UnixNano()
+	if interval, timeout := opt.KeepAlive(); interval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go s.keepalive(c, sending, &lastRecv, interval, timeout, done)
+	}
 	// 一次连接 可能对应多个请求头和请求体
 	// | Option | Header1 | Body1 | Header2 | Body2 | ...
 	for {
 		// 读取请求
-		req, err := s.readRequest(c)
+		req, err := s.readRequest(sc)
+		if req != nil {
+			atomic.StoreInt64(&lastRecv, time.Now().UnixNano())
+		}
 		if err != nil {
 			if req == nil {
 				break
 			}
 			req.h.Error = err.Error()
 			s.sendResponse(c, req.h, invalidRequest, sending)
+			atomic.AddInt64(&sc.pending, -1)
+			continue
+		}
+		switch req.h.ServiceMethod {
+		case codec.PingMethod:
+			// 异步回复, 避免写阻塞时卡住读循环
+			go s.sendResponse(c, &codec.Header{ServiceMethod: codec.PongMethod, Seq: req.h.Seq}, invalidRequest, sending)
+			atomic.AddInt64(&sc.pending, -1)
+			continue
+		case codec.PongMethod:
+			atomic.AddInt64(&sc.pending, -1)
 			continue
 		}
 		wg.Add(1)
 		// 处理请求
-		go s.handleRequest(c, req, sending, wg, opt.HandleTimeout)
+		go func(req *request) {
+			s.handleRequest(c, req, sending, wg, opt.HandleTimeout)
+			atomic.AddInt64(&sc.pending, -1)
+		}(req)
 	}
 	wg.Wait()
 	_ = c.Close()
 }
 
+// keepalive 定时向客户端发送 ping 帧
+// 超过 timeout 未收到客户端的任何消息时关闭连接, serveCodec 的读循环随之退出
+func (s *Server) keepalive(c codec.Codec, sending *sync.Mutex, lastRecv *int64, interval, timeout time.Duration, done chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(lastRecv))) > timeout {
+			log.Printf("rpc server: 心跳超时, 超时时间为%s, 关闭连接\n", timeout)
+			_ = c.Close()
+			return
+		}
+		s.sendResponse(c, &codec.Header{ServiceMethod: codec.PingMethod}, invalidRequest, sending)
+	}
+}
+
 // handleRequest 处理请求
 func (s *Server) handleRequest(c codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
 	defer wg.Done()
@@ -169,12 +379,24 @@ func (s *Server) handleRequest(c codec.Codec, req *request, sending *sync.Mutex,
 }
 
 // readRequest 读取请求
-func (s *Server) readRequest(c codec.Codec) (*request, error) {
+// 读到请求头后立即将 sc.pending 加一, 避免 Shutdown 在读取请求体时关闭连接
+// 返回的 req 不为 nil 时由调用方在请求处理完后减一, 为 nil 时已经减一
+func (s *Server) readRequest(sc *serverConn) (*request, error) {
+	c := sc.c
 	h, err := s.readRequestHeader(c)
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddInt64(&sc.pending, 1)
 	req := &request{h: h}
+	// 心跳帧没有对应的服务, 读取并丢弃消息体即可
+	if h.IsHeartbeat() {
+		if err = c.ReadBody(nil); err != nil {
+			atomic.AddInt64(&sc.pending, -1)
+			return nil, err
+		}
+		return req, nil
+	}
 	req.svc, req.mtype, err = s.findService(h.ServiceMethod)
 	if err != nil {
 		return req, err
@@ -188,7 +410,7 @@ func (s *Server) readRequest(c codec.Codec) (*request, error) {
 		argvi = req.argv.Addr().Interface()
 	}
 	if err = c.ReadBody(argvi); err != nil {
-		log.Fatalln("rpc server: 读取argv出错 err: ", err)
+		log.Println("rpc server: 读取argv出错 err: ", err)
 		return req, err
 	}
 	return req, nil
@@ -198,7 +420,7 @@ func (s *Server) readRequestHeader(c codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := c.ReadHeader(&h); err != nil {
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			log.Fatalln("rpc server: 读取header出错 err: ", err)
+			log.Println("rpc server: 读取header出错 err: ", err)
 		}
 		return nil, err
 	}
@@ -210,13 +432,16 @@ func (s *Server) sendResponse(c codec.Codec, h *codec.Header, body interface{},
 	sending.Lock()
 	defer sending.Unlock()
 	if err := c.Write(h, body); err != nil {
-		log.Fatalln("rpc server: 写入响应信息出错 err: ", err)
+		log.Println("rpc server: 写入响应信息出错 err: ", err)
 	}
 }
 
-// NewServer 返回一个新的 Server
+// NewServer 返回一个新的 Server, 已注册内置的健康检查服务, 见 HealthCheckMethod
 func NewServer() *Server {
-	return &Server{}
+	s := &Server{}
+	health := newNamedService(&Health{s: s}, healthServiceName)
+	s.serviceMap.Store(health.name, health)
+	return s
 }
 
 // DefaultServer 默认的 *Server 实例
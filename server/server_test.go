@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"gorpc/codec"
+	"gorpc/option"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	var foo Foo
+	s := NewServer()
+	_ = s.Register(&foo)
+	lis, _ := net.Listen("tcp", ":0")
+	accepted := make(chan struct{})
+	go func() {
+		s.Accept(lis)
+		close(accepted)
+	}()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(option.DefaultOption)
+	cc := codec.NewGobCodec(conn)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, Args{Num1: 1, Num2: 2})
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && cc.ReadBody(&reply) == nil && reply == 3, "expect the call to succeed")
+
+	called := make(chan struct{})
+	s.RegisterOnShutdown(func() { close(called) })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_assert(s.Shutdown(ctx) == nil, "expect the idle connection to be closed")
+	<-called
+	<-accepted
+	_, err = net.DialTimeout("tcp", lis.Addr().String(), 100*time.Millisecond)
+	_assert(err != nil, "expect the listener to be closed")
+	_assert(cc.ReadHeader(&h) != nil, "expect the connection to be closed")
+}
+
+func TestServer_ShutdownWait(t *testing.T) {
+	var foo Foo
+	s := NewServer()
+	_ = s.Register(&foo)
+	lis, _ := net.Listen("tcp", ":0")
+	go s.Accept(lis)
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(option.DefaultOption)
+	// 只发送请求头, 请求体在 Shutdown 开始后发送
+	enc := gob.NewEncoder(conn)
+	_ = enc.Encode(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1})
+	time.Sleep(50 * time.Millisecond)
+
+	hooked := make(chan struct{})
+	s.RegisterOnShutdown(func() {
+		time.Sleep(100 * time.Millisecond)
+		close(hooked)
+	})
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = enc.Encode(Args{Num1: 1, Num2: 2})
+	cc := codec.NewGobCodec(conn)
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && cc.ReadBody(&reply) == nil && reply == 3, "expect the request read during Shutdown to be handled")
+	_assert(<-done == nil, "expect Shutdown to succeed")
+	select {
+	case <-hooked:
+	default:
+		t.Fatal("expect Shutdown to wait for the shutdown hooks")
+	}
+}
+
+func TestServer_Health(t *testing.T) {
+	var foo Foo
+	s := NewServer()
+	_ = s.Register(&foo)
+	h := &Health{s: s}
+	check := func(service string) (HealthStatus, error) {
+		var resp HealthCheckResponse
+		err := h.Check(HealthCheckRequest{Service: service}, &resp)
+		return resp.Status, err
+	}
+
+	status, err := check("Foo")
+	_assert(err == nil && status == Serving, "expect Foo to be serving, but got %s %v", status, err)
+	_, err = check("Bar")
+	_assert(err != nil, "expect an error for an unknown service")
+	_, _, err = s.findService(HealthCheckMethod)
+	_assert(err == nil, "expect the built-in health service to be registered as %s", HealthCheckMethod)
+	_, _, err = s.findService("Health.Check")
+	_assert(err != nil, "expect the name Health to be left for user services")
+	_assert(len(s.Services()) == 1 && s.Services()[0] == "Foo", "expect the built-in service to be hidden, but got %v", s.Services())
+
+	s.SetServingStatus("Foo", NotServing)
+	status, _ = check("Foo")
+	_assert(status == NotServing, "expect Foo to be not serving, but got %s", status)
+	s.SetServingStatus("Foo", Serving)
+	s.SetServingStatus("", NotServing)
+	status, _ = check("Foo")
+	_assert(status == NotServing, "expect the server status to override Foo, but got %s", status)
+	s.SetServingStatus("", Serving)
+
+	_ = s.Shutdown(context.Background())
+	status, _ = check("")
+	_assert(status == NotServing, "expect not serving after Shutdown, but got %s", status)
+}
@@ -90,15 +90,21 @@ func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
 	return nil
 }
 
-// newService 将入参结构体 rcvr 映射为服务
+// newService 将入参结构体 rcvr 映射为服务, 服务名为结构体的类型名
 func newService(rcvr interface{}) *service {
+	name := reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name()
+	if !ast.IsExported(name) {
+		log.Fatalf("rpc server: 方法 %s 不可导出, 不是一个有效的服务", name)
+	}
+	return newNamedService(rcvr, name)
+}
+
+// newNamedService 将入参结构体 rcvr 映射为名为 name 的服务, 用于内置服务
+func newNamedService(rcvr interface{}, name string) *service {
 	s := new(service)
 	s.rcvr = reflect.ValueOf(rcvr)
-	s.name = reflect.Indirect(s.rcvr).Type().Name()
+	s.name = name
 	s.typ = reflect.TypeOf(rcvr)
-	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: 方法 %s 不可导出, 不是一个有效的服务", s.name)
-	}
 	s.registerMethods()
 	return s
 }
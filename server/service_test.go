@@ -48,3 +48,11 @@ func TestMethodType_Call(t *testing.T) {
 	err := s.call(mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+func TestServer_Services(t *testing.T) {
+	var foo Foo
+	s := NewServer()
+	_ = s.Register(&foo)
+	services := s.Services()
+	_assert(len(services) == 1 && services[0] == "Foo", "expect [Foo], but got %v", services)
+}
@@ -0,0 +1,182 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// PickInfo 选择实例时可以使用的调用信息
+type PickInfo struct {
+	Ctx           context.Context
+	ServiceMethod string
+	Args          interface{}
+}
+
+// Balancer 负载均衡器, 从 Discovery 返回的实例列表中选择一个实例
+// servers 已经去除了熔断中的实例, 且不为空, Pick 需要支持并发调用
+type Balancer interface {
+	Pick(servers []string, info PickInfo) (string, error)
+}
+
+// Observer Balancer 实现该接口时, XClient 在每次调用开始和结束时通知 Balancer, 用于记录实例的负载信息
+type Observer interface {
+	Start(rpcAddr string)
+	Done(rpcAddr string, elapsed time.Duration, err error)
+}
+
+// Forgetter Balancer 实现该接口时, XClient 在实例从 Discovery 中移除后调用 Forget, 删除为该实例记录的状态
+type Forgetter interface {
+	Forget(rpcAddr string)
+}
+
+// Weighter Discovery 实现该接口时, 加权负载均衡策略使用其返回的实例权重
+type Weighter interface {
+	Weight(server string) int
+}
+
+// ErrUnsupportedMode 不支持给定的负载均衡模式
+var ErrUnsupportedMode = errors.New("rpc discovery: 不支持给定的负载均衡模式")
+
+// NewBalancer 返回负载均衡模式对应的内置 Balancer
+// 加权模式的权重来自 d, d 没有实现 Weighter 时所有实例的权重均为 1
+func NewBalancer(mode SelectMode, d Discovery) (Balancer, error) {
+	weight := func(string) int { return 1 }
+	if w, ok := d.(Weighter); ok {
+		weight = w.Weight
+	}
+	switch mode {
+	case RandomSelect:
+		return NewRandomBalancer(), nil
+	case RoundRobinSelect:
+		return NewRoundRobinBalancer(), nil
+	case WeightedRoundRobinSelect:
+		return NewWeightedRoundRobinBalancer(weight), nil
+	case WeightedRandomSelect:
+		return NewWeightedRandomBalancer(weight), nil
+	case LeastPendingSelect:
+		return NewLeastPendingBalancer(), nil
+	case P2CSelect:
+		return NewP2CBalancer(), nil
+	case ConsistentHashSelect:
+		return NewConsistentHashBalancer(defaultReplicas), nil
+	default:
+		return nil, ErrUnsupportedMode
+	}
+}
+
+// randomBalancer 随机选择策略
+type randomBalancer struct {
+	mu sync.Mutex
+	r  *rand.Rand // 生成随机数
+}
+
+// NewRandomBalancer 随机选择策略
+func NewRandomBalancer() Balancer {
+	// 初始化时使用时间戳设定随机数种子
+	return &randomBalancer{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *randomBalancer) Pick(servers []string, _ PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return servers[b.r.Intn(len(servers))], nil
+}
+
+// roundRobinBalancer Round-Robin 轮询算法
+type roundRobinBalancer struct {
+	mu    sync.Mutex
+	index int // 记录上一次选择的位置
+}
+
+// NewRoundRobinBalancer Round-Robin 轮询算法, 起始位置随机, 避免所有客户端都从第一个实例开始
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{index: rand.Intn(math.MaxInt32 - 1)}
+}
+
+func (b *roundRobinBalancer) Pick(servers []string, _ PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(servers)
+	s := servers[b.index%n]
+	b.index = (b.index + 1) % n
+	return s, nil
+}
+
+// weightFunc 返回实例的权重
+type weightFunc func(server string) int
+
+// of 返回实例的权重, 小于 1 时按 1 处理
+func (f weightFunc) of(server string) int {
+	if w := f(server); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// weightedRoundRobinBalancer 平滑加权轮询算法
+type weightedRoundRobinBalancer struct {
+	weight  weightFunc
+	mu      sync.Mutex
+	current map[string]int // 每个实例的当前权重
+}
+
+// NewWeightedRoundRobinBalancer 平滑加权轮询算法, 与 nginx 相同
+// 每次选择时所有实例的当前权重加上各自的权重, 选择当前权重最大的实例, 并将其当前权重减去总权重
+// 例如权重为 {a:5, b:1, c:1} 时, 选择顺序为 a a b a c a a, 不会连续选择同一个实例
+func NewWeightedRoundRobinBalancer(weight func(server string) int) Balancer {
+	return &weightedRoundRobinBalancer{weight: weight, current: make(map[string]int)}
+}
+
+func (b *weightedRoundRobinBalancer) Forget(rpcAddr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.current, rpcAddr)
+}
+
+func (b *weightedRoundRobinBalancer) Pick(servers []string, _ PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total, best := 0, ""
+	for _, s := range servers {
+		w := b.weight.of(s)
+		total += w
+		b.current[s] += w
+		if best == "" || b.current[s] > b.current[best] {
+			best = s
+		}
+	}
+	b.current[best] -= total
+	return best, nil
+}
+
+// weightedRandomBalancer 加权随机选择策略
+type weightedRandomBalancer struct {
+	weight weightFunc
+	mu     sync.Mutex
+	r      *rand.Rand
+}
+
+// NewWeightedRandomBalancer 加权随机选择策略, 实例被选中的概率与权重成正比
+func NewWeightedRandomBalancer(weight func(server string) int) Balancer {
+	return &weightedRandomBalancer{weight: weight, r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *weightedRandomBalancer) Pick(servers []string, _ PickInfo) (string, error) {
+	total := 0
+	for _, s := range servers {
+		total += b.weight.of(s)
+	}
+	b.mu.Lock()
+	r := b.r.Intn(total)
+	b.mu.Unlock()
+	for _, s := range servers {
+		if r -= b.weight.of(s); r < 0 {
+			return s, nil
+		}
+	}
+	return servers[len(servers)-1], nil
+}
@@ -0,0 +1,193 @@
+package xclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerState 熔断器状态
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // 正常放行请求
+	BreakerOpen                         // 熔断中, 拒绝所有请求
+	BreakerHalfOpen                     // 熔断超时后放行少量探测请求, 全部成功后恢复, 任意失败则重新熔断
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrCircuitOpen 所有实例均已熔断
+var ErrCircuitOpen = errors.New("rpc xclient: 所有实例均已熔断")
+
+// BreakerPolicy 熔断策略, 每个实例地址各自维护一个熔断器
+// 只有 CodeUnavailable 和 CodeDeadlineExceeded 视为失败, 服务端返回的业务错误不会触发熔断
+type BreakerPolicy struct {
+	ConsecutiveFailures int           // 连续失败次数达到该值时熔断, 0 表示不按连续失败熔断
+	ErrorRate           float64       // 统计窗口内错误率达到该值时熔断, 0 表示不按错误率熔断
+	MinRequests         int           // 按错误率熔断时, 统计窗口内所需的最少请求数
+	Window              time.Duration // 错误率的统计窗口
+	OpenTimeout         time.Duration // 熔断后经过该时间进入半开状态
+	HalfOpenRequests    int           // 半开状态下放行的探测请求数, 小于 1 时按 1 处理
+}
+
+// DefaultBreakerPolicy 默认的熔断策略
+var DefaultBreakerPolicy = &BreakerPolicy{
+	ConsecutiveFailures: 5,
+	ErrorRate:           0.5,
+	MinRequests:         20,
+	Window:              10 * time.Second,
+	OpenTimeout:         5 * time.Second,
+	HalfOpenRequests:    1,
+}
+
+// breaker 单个实例的熔断器
+type breaker struct {
+	policy      *BreakerPolicy
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int       // 连续失败次数
+	requests    int       // 当前统计窗口内的请求数
+	failures    int       // 当前统计窗口内的失败数
+	windowStart time.Time // 当前统计窗口的开始时间
+	openedAt    time.Time // 熔断开始时间
+	probes      int       // 半开状态下已放行的探测请求数
+	successes   int       // 半开状态下探测成功数
+}
+
+func newBreaker(policy *BreakerPolicy) *breaker {
+	return &breaker{policy: policy, windowStart: time.Now()}
+}
+
+func (b *breaker) halfOpenRequests() int {
+	if b.policy.HalfOpenRequests < 1 {
+		return 1
+	}
+	return b.policy.HalfOpenRequests
+}
+
+// allow 判断是否放行请求, 放行后必须调用 done 上报结果
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.policy.OpenTimeout {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probes, b.successes = 0, 0
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probes >= b.halfOpenRequests() {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// done 上报请求结果
+func (b *breaker) done(err error) {
+	code := Code(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if code == CodeCanceled {
+		// 请求被主动取消(例如对冲请求的落选者), 不计入统计, 归还探测名额
+		if b.state == BreakerHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+		return
+	}
+	failed := code == CodeUnavailable || code == CodeDeadlineExceeded
+	switch b.state {
+	case BreakerOpen:
+		return
+	case BreakerHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+		if b.successes++; b.successes >= b.halfOpenRequests() {
+			b.close()
+		}
+		return
+	}
+	if now := time.Now(); now.Sub(b.windowStart) > b.policy.Window {
+		b.windowStart = now
+		b.requests, b.failures = 0, 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	p := b.policy
+	if p.ConsecutiveFailures > 0 && b.consecutive >= p.ConsecutiveFailures ||
+		p.ErrorRate > 0 && b.requests >= p.MinRequests && float64(b.failures)/float64(b.requests) >= p.ErrorRate {
+		b.open()
+	}
+}
+
+func (b *breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+}
+
+func (b *breaker) close() {
+	b.state = BreakerClosed
+	b.consecutive = 0
+	b.windowStart = time.Now()
+	b.requests, b.failures = 0, 0
+}
+
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// SetBreakerPolicy 设置熔断策略, 需要在发起调用前设置, p 为 nil 时关闭熔断
+func (xc *XClient) SetBreakerPolicy(p *BreakerPolicy) {
+	xc.breakerPolicy = p
+}
+
+// breaker 返回实例对应的熔断器, 未设置熔断策略时返回 nil
+func (xc *XClient) breaker(rpcAddr string) *breaker {
+	if xc.breakerPolicy == nil {
+		return nil
+	}
+	b, _ := xc.breakers.LoadOrStore(rpcAddr, newBreaker(xc.breakerPolicy))
+	return b.(*breaker)
+}
+
+// allow 判断实例的熔断器是否放行请求
+func (xc *XClient) allow(rpcAddr string) bool {
+	if b := xc.breaker(rpcAddr); b != nil {
+		return b.allow()
+	}
+	return true
+}
+
+// BreakerStates 返回所有实例的熔断器状态, 用于监控
+func (xc *XClient) BreakerStates() map[string]BreakerState {
+	states := make(map[string]BreakerState)
+	xc.breakers.Range(func(rpcAddr, b interface{}) bool {
+		states[rpcAddr.(string)] = b.(*breaker).State()
+		return true
+	})
+	return states
+}
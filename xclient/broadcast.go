@@ -0,0 +1,132 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrQuorum 成功返回的实例数达不到要求
+var ErrQuorum = errors.New("rpc xclient: 成功返回的实例数达不到要求")
+
+// BroadcastResult 单个实例的调用结果
+type BroadcastResult struct {
+	Reply interface{} // 与 reply 类型相同的响应, 调用失败时为零值
+	Err   error
+}
+
+// addrResult 并发调用时单个实例的返回
+type addrResult struct {
+	rpcAddr string
+	*BroadcastResult
+}
+
+// scatter 并发调用所有实例, 每个实例使用与 reply 类型相同的新实例接收响应
+// 返回的 channel 带缓冲, 调用方不再接收时剩余的调用不会阻塞
+func (xc *XClient) scatter(ctx context.Context, servers []string, serviceMethod string, args, reply interface{}) <-chan addrResult {
+	results := make(chan addrResult, len(servers))
+	for _, rpcAddr := range servers {
+		go func(rpcAddr string) {
+			clonedReply := newReply(reply)
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			results <- addrResult{rpcAddr, &BroadcastResult{Reply: clonedReply, Err: err}}
+		}(rpcAddr)
+	}
+	return results
+}
+
+// BroadcastAll 广播到所有的服务实例, 等待所有实例返回, 返回每个实例的响应或错误
+// reply 只用于确定响应的类型, 不会被修改; ctx 结束时立即返回, 未返回的实例的错误为 ctx 的错误
+// 只有无法获取实例列表时才返回错误
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args, reply interface{}) (map[string]*BroadcastResult, error) {
+	servers, err := xc.servers(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := xc.scatter(ctx, servers, serviceMethod, args, reply)
+	all := make(map[string]*BroadcastResult, len(servers))
+	for len(all) < len(servers) {
+		select {
+		case r := <-results:
+			all[r.rpcAddr] = r.BroadcastResult
+		case <-ctx.Done():
+			err := fmt.Errorf("rpc xclient: 调用失败 %w", ctx.Err())
+			for _, rpcAddr := range servers {
+				if _, ok := all[rpcAddr]; !ok {
+					all[rpcAddr] = &BroadcastResult{Reply: newReply(reply), Err: err}
+				}
+			}
+		}
+	}
+	return all, nil
+}
+
+// Quorum 广播到所有的服务实例, 有 n 个实例成功返回后立即返回, 并取消其余的调用
+// 返回已经返回的实例的响应或错误, 其中至少有 n 个成功的响应; reply 只用于确定响应的类型, 不会被修改
+// 失败的实例过多, 不可能再有 n 个实例成功时立即返回 ErrQuorum; n 小于 1 时按 1 处理
+func (xc *XClient) Quorum(ctx context.Context, serviceMethod string, args, reply interface{}, n int) (map[string]*BroadcastResult, error) {
+	servers, err := xc.servers(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n > len(servers) {
+		return nil, fmt.Errorf("%w: 需要 %d 个, 只有 %d 个实例", ErrQuorum, n, len(servers))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := xc.scatter(ctx, servers, serviceMethod, args, reply)
+	done := make(map[string]*BroadcastResult, len(servers))
+	succeeded, failed := 0, 0
+	for {
+		select {
+		case r := <-results:
+			done[r.rpcAddr] = r.BroadcastResult
+			if r.Err != nil {
+				failed++
+				err = r.Err
+			} else {
+				succeeded++
+			}
+			if succeeded >= n {
+				return done, nil
+			}
+			if len(servers)-failed < n {
+				return done, fmt.Errorf("%w: 需要 %d 个, %d 个实例失败, 最后一个错误: %v", ErrQuorum, n, failed, err)
+			}
+		case <-ctx.Done():
+			return done, fmt.Errorf("rpc xclient: 调用失败 %w", ctx.Err())
+		}
+	}
+}
+
+// Fork 广播到所有的服务实例, 取第一个成功的响应, 并取消其余的调用; 全部失败时返回最后一个错误
+func (xc *XClient) Fork(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.servers(serviceMethod)
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return ErrNoServers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := xc.scatter(ctx, servers, serviceMethod, args, reply)
+	for i := 0; i < len(servers); i++ {
+		select {
+		case r := <-results:
+			if r.Err == nil {
+				setReply(reply, r.Reply)
+				return nil
+			}
+			err = r.Err
+		case <-ctx.Done():
+			return fmt.Errorf("rpc xclient: 调用失败 %w", ctx.Err())
+		}
+	}
+	return err
+}
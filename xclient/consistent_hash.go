@@ -0,0 +1,138 @@
+package xclient
+
+import (
+	"context"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultReplicas 每个实例在哈希环上的虚拟节点数
+const defaultReplicas = 50
+
+// HashKeyer 参数实现该接口时, ConsistentHashSelect 使用 HashKey 的返回值作为键
+type HashKeyer interface {
+	HashKey() string
+}
+
+type hashKeyCtxKey struct{}
+
+// WithHashKey 为本次调用指定 ConsistentHashSelect 的键, 优先级高于参数实现的 HashKeyer
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtxKey{}, key)
+}
+
+// hashKey 返回本次调用的键, 没有指定时返回 false
+func hashKey(ctx context.Context, args interface{}) (string, bool) {
+	if key, ok := ctx.Value(hashKeyCtxKey{}).(string); ok {
+		return key, true
+	}
+	if k, ok := args.(HashKeyer); ok {
+		return k.HashKey(), true
+	}
+	return "", false
+}
+
+// hashRing 一致性哈希环
+// 每个实例对应 replicas 个虚拟节点, 实例增减时只有相邻虚拟节点上的键会重新映射
+type hashRing struct {
+	replicas int
+	servers  []string          // 构建哈希环时的实例列表, 已排序, 用于判断实例列表是否变化
+	keys     []uint32          // 已排序的虚拟节点哈希值
+	nodes    map[uint32]string // 虚拟节点哈希值与实例的映射
+}
+
+func newHashRing(replicas int, servers []string) *hashRing {
+	r := &hashRing{
+		replicas: replicas,
+		servers:  append([]string(nil), servers...),
+		nodes:    make(map[uint32]string),
+	}
+	sort.Strings(r.servers)
+	for _, s := range r.servers {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + s))
+			r.keys = append(r.keys, h)
+			r.nodes[h] = s
+		}
+	}
+	sort.Slice(r.keys, func(i, j int) bool { return r.keys[i] < r.keys[j] })
+	return r
+}
+
+// contains 判断哈希环是否包含 servers 中的所有实例
+func (r *hashRing) contains(servers []string) bool {
+	for _, s := range servers {
+		i := sort.SearchStrings(r.servers, s)
+		if i == len(r.servers) || r.servers[i] != s {
+			return false
+		}
+	}
+	return true
+}
+
+// walk 从键的位置开始顺时针遍历哈希环, 按顺序返回所有不重复的实例
+func (r *hashRing) walk(key string) []string {
+	if len(r.keys) == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= h })
+	seen := make(map[string]bool, len(r.servers))
+	servers := make([]string, 0, len(r.servers))
+	for i := 0; i < len(r.keys) && len(servers) < len(r.servers); i++ {
+		s := r.nodes[r.keys[(start+i)%len(r.keys)]]
+		if !seen[s] {
+			seen[s] = true
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// consistentHashBalancer 一致性哈希
+type consistentHashBalancer struct {
+	replicas int
+	mu       sync.Mutex
+	ring     *hashRing
+}
+
+// NewConsistentHashBalancer 一致性哈希, 键来自 WithHashKey 或实现了 HashKeyer 的参数, 键相同的调用落在同一个实例上
+// replicas 为每个实例的虚拟节点数, 没有指定键时随机选择
+func NewConsistentHashBalancer(replicas int) Balancer {
+	return &consistentHashBalancer{replicas: replicas}
+}
+
+func (b *consistentHashBalancer) Pick(servers []string, info PickInfo) (string, error) {
+	key, ok := "", false
+	if info.Ctx != nil {
+		key, ok = hashKey(info.Ctx, info.Args)
+	}
+	if !ok {
+		key = strconv.Itoa(rand.Int())
+	}
+	// 哈希环上第一个在 servers 中的实例, 被熔断或跳过的实例上的键会落到顺时针的下一个实例
+	candidates := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		candidates[s] = true
+	}
+	for _, s := range b.getRing(servers).walk(key) {
+		if candidates[s] {
+			return s, nil
+		}
+	}
+	return servers[0], nil
+}
+
+// getRing 返回包含 servers 的哈希环
+// servers 只是减少了部分实例时(例如熔断)沿用原有的哈希环, 出现新的实例时重新构建
+func (b *consistentHashBalancer) getRing(servers []string) *hashRing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ring == nil || !b.ring.contains(servers) {
+		b.ring = newHashRing(b.replicas, servers)
+	}
+	return b.ring
+}
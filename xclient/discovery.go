@@ -2,31 +2,61 @@ package xclient
 
 import (
 	"errors"
-	"math"
-	"math/rand"
+	"sort"
 	"sync"
-	"time"
 )
 
 type SelectMode int
 
 const (
-	RandomSelect     SelectMode = iota // 随机选择策略
-	RoundRobinSelect                   // Round-Robin 轮询算法
+	RandomSelect             SelectMode = iota // 随机选择策略
+	RoundRobinSelect                           // Round-Robin 轮询算法
+	WeightedRoundRobinSelect                   // 平滑加权轮询算法, 与 nginx 相同
+	WeightedRandomSelect                       // 加权随机选择策略
+	// 以下策略需要 XClient 记录的调用信息, 只能通过 XClient 使用, MultiServersDiscovery.Get 不支持
+	LeastPendingSelect // 选择未完成调用数最少的实例
+	P2CSelect          // Power of Two Choices, 随机选择两个实例, 取 peak EWMA 延迟与未完成调用数乘积较小的一个
+	// 一致性哈希, 键来自 WithHashKey 或实现了 HashKeyer 的参数, 键相同的调用落在同一个实例上
+	ConsistentHashSelect
 )
 
+// ErrNoServers 没有可以访问的实例
+var ErrNoServers = errors.New("rpc discovery: 没有发现可以访问的实例")
+
+// Discovery 服务发现, 只负责维护服务实例列表, 选择实例由 Balancer 负责
 type Discovery interface {
-	Refresh() error                      // 从注册中心更新服务列表
-	Update(servers []string) error       // 手动更新服务列表
-	Get(mode SelectMode) (string, error) // 根据负载均衡策略, 选择一个服务实例
-	GetAll() ([]string, error)           // 返回所有的服务实例
+	Refresh() error                // 从注册中心更新服务列表
+	Update(servers []string) error // 手动更新服务列表
+	GetAll() ([]string, error)     // 返回所有的服务实例
+}
+
+// Metadata 实例的元数据, 由实例注册到注册中心时上报
+type Metadata struct {
+	Weight  int               // 权重, 0 表示未设置
+	Version string            // 实例的版本号, 例如 1.2.0
+	Zone    string            // 实例所在的可用区
+	Tags    map[string]string // 其他元数据, 例如 canary=true
+}
+
+// MetadataDiscovery Discovery 实现该接口时, 自定义的 Balancer 可以根据实例的元数据选择实例
+type MetadataDiscovery interface {
+	// Metadata 返回实例的元数据, 实例没有上报元数据时返回 false
+	Metadata(server string) (Metadata, bool)
+}
+
+// ServiceDiscovery Discovery 实现该接口时, XClient 只从提供了被调用服务的实例中选择
+type ServiceDiscovery interface {
+	// GetService 返回提供服务 service 的实例, 不知道提供哪些服务的实例也会被返回
+	GetService(service string) ([]string, error)
 }
 
 type MultiServersDiscovery struct {
-	r       *rand.Rand   // 生成随机数
-	mu      sync.RWMutex // 读写锁, 保护对注册地址的读写
-	servers []string     // 实例地址列表
-	index   int          // Round-Robin 轮询算法中需要记录上一次选择的位置
+	mu        sync.RWMutex            // 读写锁, 保护对注册地址的读写
+	servers   []string                // 实例地址列表
+	weights   map[string]int          // 实例权重, 未设置权重的实例权重为 1
+	services  map[string][]string     // 实例提供的服务, 不在其中的实例认为提供所有服务
+	metadata  map[string]Metadata     // 实例的元数据
+	balancers map[SelectMode]Balancer // Get 使用的负载均衡器
 }
 
 // Refresh 从注册中心更新服务列表
@@ -42,24 +72,89 @@ func (m *MultiServersDiscovery) Update(servers []string) error {
 	return nil
 }
 
-// Get 根据负载均衡策略, 选择一个服务实例
-func (m *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
+// UpdateWeights 手动更新实例权重, 未设置权重或权重小于 1 的实例权重为 1
+func (m *MultiServersDiscovery) UpdateWeights(weights map[string]int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.weights = weights
+	return nil
+}
+
+// UpdateServices 手动更新每个实例提供的服务, 不在 services 中的实例认为提供所有服务
+func (m *MultiServersDiscovery) UpdateServices(services map[string][]string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	n := len(m.servers)
-	if n == 0 {
-		return "", errors.New("rpc discovery: 没有发现可以访问的实例")
+	m.services = services
+	return nil
+}
+
+// UpdateMetadata 手动更新实例的元数据, 元数据中的权重会覆盖 UpdateWeights 设置的权重
+func (m *MultiServersDiscovery) UpdateMetadata(metadata map[string]Metadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metadata = metadata
+	return nil
+}
+
+// Metadata 返回实例的元数据, 实现 MetadataDiscovery 接口
+func (m *MultiServersDiscovery) Metadata(server string) (Metadata, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	md, ok := m.metadata[server]
+	return md, ok
+}
+
+// GetService 返回提供服务 service 的实例, 实现 ServiceDiscovery 接口
+func (m *MultiServersDiscovery) GetService(service string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	servers := make([]string, 0, len(m.servers))
+	for _, s := range m.servers {
+		if hosts(m.services[s], service) {
+			servers = append(servers, s)
+		}
+	}
+	return servers, nil
+}
+
+// hosts 判断提供 services 的实例是否提供服务 service, services 为空表示提供所有服务
+func hosts(services []string, service string) bool {
+	if len(services) == 0 {
+		return true
+	}
+	for _, s := range services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Weight 返回实例的权重, 实现 Weighter 接口
+func (m *MultiServersDiscovery) Weight(server string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if w := m.metadata[server].Weight; w > 0 {
+		return w
 	}
-	switch mode {
-	case RandomSelect:
-		return m.servers[m.r.Intn(n)], nil
-	case RoundRobinSelect:
-		s := m.servers[m.index%n]
-		m.index = (m.index + 1) % n
-		return s, nil
-	default:
-		return "", errors.New("rpc discovery: 不支持给定的负载均衡模式")
+	if w := m.weights[server]; w > 0 {
+		return w
 	}
+	return 1
+}
+
+// Get 根据负载均衡策略, 选择一个服务实例
+// 只支持不依赖调用信息的策略, 其余策略需要通过 XClient 使用
+func (m *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
+	servers, _ := m.GetAll()
+	if len(servers) == 0 {
+		return "", ErrNoServers
+	}
+	b := m.balancers[mode]
+	if b == nil {
+		return "", ErrUnsupportedMode
+	}
+	return b.Pick(servers, PickInfo{})
 }
 
 // GetAll 返回所有的服务实例
@@ -67,19 +162,37 @@ func (m *MultiServersDiscovery) GetAll() ([]string, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	// 拷贝一份新的实例列表, 避免误修改
-	servers := make([]string, 0, len(m.servers))
+	servers := make([]string, len(m.servers))
 	copy(servers, m.servers)
 	return servers, nil
 }
 
 // NewMultiServersDiscovery 新建服务发现
 func NewMultiServersDiscovery(servers []string) *MultiServersDiscovery {
-	d := &MultiServersDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())), // 初始化时使用时间戳设定随机数种子
+	d := &MultiServersDiscovery{servers: servers}
+	d.balancers = map[SelectMode]Balancer{
+		RandomSelect:             NewRandomBalancer(),
+		RoundRobinSelect:         NewRoundRobinBalancer(),
+		WeightedRoundRobinSelect: NewWeightedRoundRobinBalancer(d.Weight),
+		WeightedRandomSelect:     NewWeightedRandomBalancer(d.Weight),
+	}
+	return d
+}
+
+// NewWeightedMultiServersDiscovery 新建带权重的服务发现, 服务列表为 weights 中的所有实例
+func NewWeightedMultiServersDiscovery(weights map[string]int) *MultiServersDiscovery {
+	servers := make([]string, 0, len(weights))
+	for s := range weights {
+		servers = append(servers, s)
 	}
-	d.index = d.r.Intn(math.MaxInt32 - 1)
+	sort.Strings(servers)
+	d := NewMultiServersDiscovery(servers)
+	d.weights = weights
 	return d
 }
 
-var _ Discovery = (*MultiServersDiscovery)(nil)
+var (
+	_ Discovery         = (*MultiServersDiscovery)(nil)
+	_ ServiceDiscovery  = (*MultiServersDiscovery)(nil)
+	_ MetadataDiscovery = (*MultiServersDiscovery)(nil)
+)
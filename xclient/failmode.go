@@ -0,0 +1,24 @@
+package xclient
+
+import (
+	"context"
+	"time"
+)
+
+// FailMode 调用失败时的处理策略, 只对通过 XClient.SetIdempotent 标记为幂等的方法生效
+// Failover 和 Failtry 按 XClient.SetRetryPolicy 设置的重试策略重试, 没有设置时使用 DefaultRetryPolicy
+type FailMode int
+
+const (
+	Failover   FailMode = iota // 失败后按 RetryPolicy 重新选择其他实例重试
+	Failfast                   // 失败后立即返回错误
+	Failtry                    // 失败后按 RetryPolicy 重试同一个实例
+	Failbackup                 // 第一个实例超过 BackupLatency 仍未返回或者失败时, 向第二个实例发送同样的请求, 取先成功的结果
+)
+
+const defaultBackupLatency = 10 * time.Millisecond
+
+// callBackup Failbackup 模式的调用, 相当于最多发出 2 个请求, 等待时间为 xc.backup 的对冲请求
+func (xc *XClient) callBackup(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	return xc.hedge(ctx, serviceMethod, args, reply, xc.backup, 2)
+}
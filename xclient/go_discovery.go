@@ -1,17 +1,46 @@
 package xclient
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"gorpc/client"
+	"gorpc/registry"
 )
 
+// ErrStale 服务列表超过 maxStaleness 没有从注册中心成功刷新
+var ErrStale = errors.New("rpc registry: 服务列表已经过期")
+
+// GoRegistryDiscovery 基于 GoRegistry 的服务发现
+// 后台按 timeout 的间隔从注册中心刷新服务列表, 获取服务列表时不会等待网络请求
+// 注册中心不可用时继续使用最后一次成功获取的服务列表, 超过 maxStaleness 后返回 ErrStale
+// 通过 NewGoRegistryWatchDiscovery 创建时改为 watch 注册中心, 服务列表变化后立即更新
+// 注册中心地址可以是以逗号分隔的多个集群节点, 请求失败时依次切换到下一个节点
 type GoRegistryDiscovery struct {
 	*MultiServersDiscovery
-	registry   string        // 注册中心地址
-	timeout    time.Duration // 超时时间
-	lastUpdate time.Time     // 上次更新时间
+	registries   []string      // 注册中心地址
+	current      int           // 上次请求成功的注册中心, 由 mu 保护
+	timeout      time.Duration // 刷新间隔
+	maxStaleness time.Duration // 服务列表允许的最长未刷新时间, 0 表示不限制
+	httpClient   *http.Client
+	refreshing   sync.Mutex // 保证同一时刻只有一个刷新请求
+	lastUpdate   time.Time  // 上次成功更新的时间, 由 mu 保护
+	lastErr      error      // 最近一次刷新的错误, 由 mu 保护
+	revision     uint64     // 服务列表的版本号, 0 表示注册中心不支持版本号, 由 mu 保护
+	source       string     // 当前服务列表来自的注册中心, 由 mu 保护
+	requests     uint64     // 已经发出的请求数, 用于给请求编号, 由 mu 保护
+	appliedSeq   uint64     // 已经应用的最新的请求编号, 由 mu 保护
+	watch        bool       // 是否 watch 注册中心
+	ctx          context.Context
+	cancel       context.CancelFunc // 停止后台刷新
 }
 
 // Update 手动更新服务列表
@@ -20,41 +49,233 @@ func (r *GoRegistryDiscovery) Update(servers []string) error {
 	defer r.mu.Unlock()
 	r.servers = servers
 	r.lastUpdate = time.Now()
+	r.lastErr = nil
 	return nil
 }
 
-// Refresh 从注册中心更新服务列表
+// Refresh 立即从注册中心更新服务列表, 网络请求期间不持有锁, 不影响读取服务列表
 func (r *GoRegistryDiscovery) Refresh() error {
+	r.refreshing.Lock()
+	defer r.refreshing.Unlock()
+	return r.apply(r.fetchAny(context.Background(), r.httpClient, 0))
+}
+
+// registryState 注册中心返回的服务列表
+type registryState struct {
+	servers  []string
+	services map[string][]string // 每个实例提供的服务
+	metadata map[string]Metadata // 每个实例的元数据
+	revision uint64              // 服务列表的版本号, 注册中心不支持版本号时为 0
+	registry string              // 返回服务列表的注册中心
+	seq      uint64              // 请求的编号, 越大表示请求发出得越晚
+}
+
+// apply 使用注册中心返回的服务列表更新本地的服务列表
+// Refresh 与 watch 并发时, 较早发出的请求可能较晚返回, 来自同一个注册中心且版本号更旧的服务列表会被丢弃
+// 注册中心重启后版本号会变小, 此时较晚发出的请求返回的服务列表仍然会被应用
+func (r *GoRegistryDiscovery) apply(state *registryState, err error) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if r.lastUpdate.Add(r.timeout).After(time.Now()) {
-		// 未过期, 无需刷新
-		return nil
-	}
-	// 超时, 重新获取服务列表
-	log.Println("rpc registry: 刷新注册中心服务列表 ", r.registry)
-	resp, err := http.Get(r.registry)
+	r.lastErr = err
 	if err != nil {
 		log.Println("rpc registry: 注册中心刷新出现错误 ", err)
 		return err
 	}
-	// 获取所有在线的服务列表
-	servers := strings.Split(resp.Header.Get("X-Gorpc-Servers"), ",")
-	r.servers = make([]string, 0, len(servers))
-	for _, s := range servers {
+	if state.registry == r.source && state.revision < r.revision && state.seq < r.appliedSeq {
+		return nil
+	}
+	if state.seq > r.appliedSeq {
+		r.appliedSeq = state.seq
+	}
+	r.source = state.registry
+	r.lastUpdate = time.Now()
+	r.servers = state.servers
+	r.services = state.services
+	r.metadata = state.metadata
+	r.revision = state.revision
+	return nil
+}
+
+// fetchAny 从上次请求成功的注册中心开始依次请求, 返回第一个成功的结果, 全部失败时返回最后一个错误
+// revision 不为 0 时为 watch 请求, 每个节点的版本号各自计数, 因此只发给上次请求成功的节点
+// 切换到其他节点时不带版本号, 该节点立即返回其服务列表
+func (r *GoRegistryDiscovery) fetchAny(ctx context.Context, c *http.Client, revision uint64) (*registryState, error) {
+	r.mu.Lock()
+	current := r.current
+	r.requests++
+	seq := r.requests
+	r.mu.Unlock()
+	err := errors.New("rpc registry: 没有设置注册中心地址")
+	for i := range r.registries {
+		n := (current + i) % len(r.registries)
+		req, _ := http.NewRequestWithContext(ctx, "GET", r.registries[n], nil)
+		if revision != 0 && n == current {
+			req.Header.Set("X-Gorpc-Revision", strconv.FormatUint(revision, 10))
+		}
+		var state *registryState
+		if state, err = r.fetch(c, req); err == nil {
+			if n != current {
+				log.Println("rpc registry: 切换到注册中心 ", r.registries[n])
+				r.mu.Lock()
+				r.current = n
+				r.mu.Unlock()
+			}
+			state.registry, state.seq = r.registries[n], seq
+			return state, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// fetch 请求注册中心, 返回所有在线的服务列表
+// 优先使用包含实例元数据的 JSON 格式, 注册中心不支持时使用响应头中的服务列表
+func (r *GoRegistryDiscovery) fetch(c *http.Client, req *http.Request) (*registryState, error) {
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rpc registry: 注册中心返回 %s", resp.Status)
+	}
+	state := &registryState{
+		services: make(map[string][]string),
+		metadata: make(map[string]Metadata),
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Revision uint64                `json:"revision"`
+			Servers  []registry.ServerItem `json:"servers"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		state.revision = body.Revision
+		for _, s := range body.Servers {
+			state.servers = append(state.servers, s.Addr)
+			if len(s.Services) > 0 {
+				state.services[s.Addr] = s.Services
+			}
+			if s.Weight != 0 || s.Version != "" || s.Zone != "" || len(s.Tags) > 0 {
+				state.metadata[s.Addr] = Metadata{Weight: s.Weight, Version: s.Version, Zone: s.Zone, Tags: s.Tags}
+			}
+		}
+		return state, nil
+	}
+	state.servers = splitServers(resp.Header.Get("X-Gorpc-Servers"))
+	state.revision, _ = strconv.ParseUint(resp.Header.Get("X-Gorpc-Revision"), 10, 64)
+	// X-Gorpc-Services 的格式为 addr=Service1|Service2,addr=Service1
+	for _, item := range splitServers(resp.Header.Get("X-Gorpc-Services")) {
+		if i := strings.LastIndex(item, "="); i > 0 {
+			state.services[item[:i]] = strings.Split(item[i+1:], "|")
+		}
+	}
+	return state, nil
+}
+
+// splitServers 解析以逗号分隔的服务列表
+func splitServers(header string) []string {
+	parts := strings.Split(header, ",")
+	servers := make([]string, 0, len(parts))
+	for _, s := range parts {
 		s = strings.TrimSpace(s)
 		if s != "" {
-			r.servers = append(r.servers, s)
+			servers = append(servers, s)
 		}
 	}
-	r.lastUpdate = time.Now()
+	return servers
+}
+
+// run 后台定时刷新服务列表, 直到 Close
+func (r *GoRegistryDiscovery) run() {
+	if r.watch {
+		r.watchLoop()
+		return
+	}
+	t := time.NewTicker(r.timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-t.C:
+			_ = r.Refresh()
+		}
+	}
+}
+
+// watchLoop 持续向注册中心发送 watch 请求, 服务列表变化后注册中心立即返回
+// 请求失败时按 client.DefaultBackoff 退避, 注册中心不支持 watch 时退化为每隔 timeout 刷新一次
+func (r *GoRegistryDiscovery) watchLoop() {
+	// watch 请求会在注册中心阻塞, 不能使用刷新用的 httpClient, 超时时间需要大于注册中心最长的等待时间
+	// 连接半开时请求在超时后失败, 然后切换到下一个注册中心
+	c := &http.Client{Timeout: watchRequestTimeout}
+	for attempt := 0; ; {
+		r.mu.RLock()
+		revision := r.revision
+		r.mu.RUnlock()
+		state, err := r.fetchAny(r.ctx, c, revision)
+		if r.ctx.Err() != nil {
+			return
+		}
+		_ = r.apply(state, err)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			wait = client.DefaultBackoff.Duration(attempt)
+			attempt++
+		case state.revision == 0:
+			wait = r.timeout
+			attempt = 0
+		default:
+			attempt = 0
+		}
+		if wait > 0 {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// check 检查服务列表是否可用
+// 还没有成功刷新过时同步刷新一次, 服务列表超过 maxStaleness 没有刷新时返回 ErrStale
+func (r *GoRegistryDiscovery) check() error {
+	r.mu.RLock()
+	lastUpdate, err, maxStaleness := r.lastUpdate, r.lastErr, r.maxStaleness
+	r.mu.RUnlock()
+	if lastUpdate.IsZero() {
+		return r.Refresh()
+	}
+	if maxStaleness > 0 && time.Since(lastUpdate) > maxStaleness {
+		return fmt.Errorf("%w: 上次刷新于 %s, 最近一次错误: %v", ErrStale, lastUpdate.Format(time.RFC3339), err)
+	}
 	return nil
 }
 
+// LastRefresh 返回上次成功刷新服务列表的时间, 以及最近一次刷新的错误, 最近一次刷新成功时错误为 nil
+func (r *GoRegistryDiscovery) LastRefresh() (time.Time, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastUpdate, r.lastErr
+}
+
+// SetMaxStaleness 设置服务列表允许的最长未刷新时间, 超过后获取服务列表返回 ErrStale, 0 表示不限制
+func (r *GoRegistryDiscovery) SetMaxStaleness(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxStaleness = d
+}
+
 // Get 根据负载均衡策略, 选择一个服务实例
 func (r *GoRegistryDiscovery) Get(mode SelectMode) (string, error) {
-	// 获取服务前需要进行一次刷新, 确保服务列表没有过期
-	if err := r.Refresh(); err != nil {
+	if err := r.check(); err != nil {
 		return "", err
 	}
 	return r.MultiServersDiscovery.Get(mode)
@@ -62,22 +283,63 @@ func (r *GoRegistryDiscovery) Get(mode SelectMode) (string, error) {
 
 // GetAll 返回所有的服务实例
 func (r *GoRegistryDiscovery) GetAll() ([]string, error) {
-	// 获取服务前需要进行一次刷新, 确保服务列表没有过期
-	if err := r.Refresh(); err != nil {
+	if err := r.check(); err != nil {
 		return nil, err
 	}
 	return r.MultiServersDiscovery.GetAll()
 }
 
-const defaultUpdateTimeout = 1 * time.Second
+// GetService 返回提供服务 service 的实例, 服务信息来自实例注册时上报的 Server.Services
+func (r *GoRegistryDiscovery) GetService(service string) ([]string, error) {
+	if err := r.check(); err != nil {
+		return nil, err
+	}
+	return r.MultiServersDiscovery.GetService(service)
+}
 
+// Close 停止后台刷新, 可以重复调用, 传给 NewXClient 后由 XClient.Close 关闭
+func (r *GoRegistryDiscovery) Close() error {
+	r.cancel()
+	return nil
+}
+
+const (
+	defaultUpdateTimeout = 1 * time.Second
+	defaultMaxStaleness  = 1 * time.Minute // 注册中心不可用时, 继续使用旧的服务列表的最长时间
+	// watchRequestTimeout watch 请求的超时时间, 注册中心最长等待 30s 后返回, 留出网络传输的余量
+	watchRequestTimeout = 40 * time.Second
+)
+
+// NewGoRegistryDiscovery 新建基于 GoRegistry 的服务发现, 并在后台每隔 timeout 刷新一次服务列表
+// registry 为注册中心集群时使用逗号分隔多个节点的地址
+// 不再使用时需要调用 Close 停止后台刷新, 传给 NewXClient 时由 XClient.Close 关闭
 func NewGoRegistryDiscovery(registry string, timeout time.Duration) *GoRegistryDiscovery {
+	r := newGoRegistryDiscovery(registry, timeout)
+	go r.run()
+	return r
+}
+
+// NewGoRegistryWatchDiscovery 新建 watch 注册中心的服务发现, 注册中心的服务列表变化后立即更新
+// 注册中心不支持 watch 时退化为每隔 timeout 刷新一次
+// 不再使用时需要调用 Close 停止 watch, 传给 NewXClient 时由 XClient.Close 关闭
+func NewGoRegistryWatchDiscovery(registry string, timeout time.Duration) *GoRegistryDiscovery {
+	r := newGoRegistryDiscovery(registry, timeout)
+	r.watch = true
+	go r.run()
+	return r
+}
+
+func newGoRegistryDiscovery(registry string, timeout time.Duration) *GoRegistryDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
 	}
-	return &GoRegistryDiscovery{
+	r := &GoRegistryDiscovery{
 		MultiServersDiscovery: NewMultiServersDiscovery(make([]string, 0)),
-		registry:              registry,
+		registries:            splitServers(registry),
 		timeout:               timeout,
+		maxStaleness:          defaultMaxStaleness,
+		httpClient:            &http.Client{Timeout: timeout},
 	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
 }
@@ -0,0 +1,168 @@
+package xclient
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgePolicy 对冲请求策略, 对通过 XClient.SetReadOnly 标记为只读的方法生效
+// 第一个请求超过等待时间仍未返回时, 向另一个实例发送同样的请求, 取先成功的结果并取消其余请求
+type HedgePolicy struct {
+	Delay time.Duration // 发送下一个请求前的等待时间
+	// 大于 0 时使用该方法最近调用延迟的分位数作为等待时间, 例如 0.95 表示 p95, 样本不足时使用 Delay
+	Percentile  float64
+	MaxAttempts int // 最多发出的请求数(包含第一次), 小于 2 时按 2 处理
+}
+
+const (
+	latencyWindowSize = 100 // 每个方法保留最近的延迟样本数
+	latencyMinSamples = 10  // 计算分位数所需的最少样本数
+)
+
+// latencyWindow 记录最近 latencyWindowSize 次成功调用的延迟
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int // 样本写满后, 下一个被覆盖的位置
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// percentile 返回延迟的 p 分位数, 样本不足时返回 false
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	samples := make([]time.Duration, len(w.samples))
+	copy(samples, w.samples)
+	w.mu.Unlock()
+	if len(samples) < latencyMinSamples {
+		return 0, false
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(p * float64(len(samples)))
+	if i >= len(samples) {
+		i = len(samples) - 1
+	}
+	return samples[i], true
+}
+
+// SetHedgePolicy 设置对冲请求策略, 需要在发起调用前设置, p 为 nil 时关闭对冲
+func (xc *XClient) SetHedgePolicy(p *HedgePolicy) {
+	xc.hedging = p
+}
+
+// SetReadOnly 将方法标记为只读, 格式为 <service>.<method>, 需要在发起调用前设置
+// 只读的方法同时也是幂等的, 设置了对冲策略时会发送对冲请求
+func (xc *XClient) SetReadOnly(serviceMethods ...string) {
+	for _, serviceMethod := range serviceMethods {
+		xc.readOnly[serviceMethod] = true
+	}
+	xc.SetIdempotent(serviceMethods...)
+}
+
+// latency 返回方法对应的延迟记录
+func (xc *XClient) latency(serviceMethod string) *latencyWindow {
+	w, _ := xc.latencies.LoadOrStore(serviceMethod, new(latencyWindow))
+	return w.(*latencyWindow)
+}
+
+// callHedged 按对冲策略调用
+func (xc *XClient) callHedged(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	p := xc.hedging
+	delay := p.Delay
+	if p.Percentile > 0 {
+		if d, ok := xc.latency(serviceMethod).percentile(p.Percentile); ok {
+			delay = d
+		}
+	}
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 2 {
+		maxAttempts = 2
+	}
+	return xc.hedge(ctx, serviceMethod, args, reply, delay, maxAttempts)
+}
+
+// hedge 先向一个实例发送请求, 每隔 delay 仍未成功返回时, 或者已发出的请求失败时, 向另一个实例发送同样的请求
+// 最多发出 maxAttempts 个请求, 取先成功返回的结果, 返回后取消其余请求; 全部失败时返回最后一个错误
+func (xc *XClient) hedge(ctx context.Context, serviceMethod string, args, reply interface{}, delay time.Duration, maxAttempts int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		reply   interface{}
+		err     error
+		elapsed time.Duration
+	}
+	// 带缓冲, 返回后剩余的请求不会阻塞
+	results := make(chan result, maxAttempts)
+	tried := make(map[string]bool)
+	sent := 0
+	send := func() error {
+		rpcAddr, err := xc.pick(ctx, serviceMethod, args, tried)
+		if err != nil {
+			// 无法选择实例, 不再发送新的请求
+			sent = maxAttempts
+			return err
+		}
+		tried[rpcAddr] = true
+		sent++
+		go func() {
+			start := time.Now()
+			clonedReply := newReply(reply)
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			results <- result{reply: clonedReply, err: err, elapsed: time.Since(start)}
+		}()
+		return nil
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	pending := 1
+	var err error
+	for pending > 0 {
+		var next <-chan time.Time
+		if sent < maxAttempts {
+			next = t.C
+		}
+		select {
+		case <-next:
+			if send() == nil {
+				pending++
+			}
+			t.Reset(delay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				xc.latency(serviceMethod).add(r.elapsed)
+				setReply(reply, r.reply)
+				return nil
+			}
+			err = r.err
+			// 请求失败, 立即发送下一个请求, 并重新计时
+			if sent < maxAttempts {
+				if send() == nil {
+					pending++
+				}
+				if !t.Stop() {
+					select {
+					case <-t.C:
+					default:
+					}
+				}
+				t.Reset(delay)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package xclient
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ewmaDecay      = 10 * time.Second       // peak EWMA 的衰减时间, 越大历史延迟的影响越久
+	ewmaDefaultRTT = 100 * time.Millisecond // 还没有延迟样本的实例使用的默认延迟
+)
+
+// addrStats 单个实例的负载信息
+type addrStats struct {
+	inflight int64 // 未完成的调用数, 包含建立连接期间的调用
+
+	mu   sync.Mutex
+	ewma float64   // peak EWMA 延迟(纳秒), 0 表示还没有样本
+	last time.Time // 上一次更新 ewma 的时间
+}
+
+// start 调用开始
+func (s *addrStats) start() {
+	atomic.AddInt64(&s.inflight, 1)
+}
+
+// done 调用结束, 更新延迟, 主动取消的调用不计入延迟
+func (s *addrStats) done(elapsed time.Duration, err error) {
+	atomic.AddInt64(&s.inflight, -1)
+	if Code(err) == CodeCanceled {
+		return
+	}
+	now := time.Now()
+	rtt := float64(elapsed)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rtt > s.ewma {
+		// 延迟升高时立即生效, 尽快避开变慢的实例
+		s.ewma = rtt
+	} else {
+		// 延迟降低时按时间衰减, 距离上一次更新越久, 新样本的权重越大
+		w := math.Exp(-float64(now.Sub(s.last)) / float64(ewmaDecay))
+		s.ewma = s.ewma*w + rtt*(1-w)
+	}
+	s.last = now
+}
+
+// pending 返回未完成的调用数
+func (s *addrStats) pending() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+// cost 返回 peak EWMA 延迟与未完成调用数的乘积, 值越小越应该被选中
+func (s *addrStats) cost() float64 {
+	s.mu.Lock()
+	ewma := s.ewma
+	s.mu.Unlock()
+	if ewma == 0 {
+		ewma = float64(ewmaDefaultRTT)
+	}
+	return ewma * float64(s.pending()+1)
+}
+
+// loadTracker 记录每个实例的负载信息, 实现 Observer 接口
+type loadTracker struct {
+	loads sync.Map // map[string]*addrStats
+}
+
+// stats 返回实例对应的负载信息
+func (t *loadTracker) stats(rpcAddr string) *addrStats {
+	st, _ := t.loads.LoadOrStore(rpcAddr, new(addrStats))
+	return st.(*addrStats)
+}
+
+func (t *loadTracker) Start(rpcAddr string) {
+	t.stats(rpcAddr).start()
+}
+
+func (t *loadTracker) Done(rpcAddr string, elapsed time.Duration, err error) {
+	t.stats(rpcAddr).done(elapsed, err)
+}
+
+func (t *loadTracker) Forget(rpcAddr string) {
+	t.loads.Delete(rpcAddr)
+}
+
+// leastPendingBalancer 选择未完成调用数最少的实例
+type leastPendingBalancer struct {
+	loadTracker
+}
+
+// NewLeastPendingBalancer 选择未完成调用数最少的实例, 数量相同时随机选择
+func NewLeastPendingBalancer() Balancer {
+	return new(leastPendingBalancer)
+}
+
+func (b *leastPendingBalancer) Pick(servers []string, _ PickInfo) (string, error) {
+	offset := rand.Intn(len(servers))
+	best, min := "", int64(math.MaxInt64)
+	for i := range servers {
+		s := servers[(offset+i)%len(servers)]
+		if p := b.stats(s).pending(); p < min {
+			best, min = s, p
+		}
+	}
+	return best, nil
+}
+
+// p2cBalancer Power of Two Choices
+type p2cBalancer struct {
+	loadTracker
+}
+
+// NewP2CBalancer Power of Two Choices, 随机选择两个实例, 取 peak EWMA 延迟与未完成调用数乘积较小的一个
+func NewP2CBalancer() Balancer {
+	return new(p2cBalancer)
+}
+
+func (b *p2cBalancer) Pick(servers []string, _ PickInfo) (string, error) {
+	if len(servers) == 1 {
+		return servers[0], nil
+	}
+	i := rand.Intn(len(servers))
+	j := rand.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	x, y := servers[i], servers[j]
+	if b.stats(y).cost() < b.stats(x).cost() {
+		return y, nil
+	}
+	return x, nil
+}
+
+var (
+	_ Observer  = (*leastPendingBalancer)(nil)
+	_ Observer  = (*p2cBalancer)(nil)
+	_ Forgetter = (*leastPendingBalancer)(nil)
+	_ Forgetter = (*p2cBalancer)(nil)
+)
@@ -0,0 +1,238 @@
+package xclient
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorpc/client"
+	"gorpc/option"
+)
+
+// PoolPolicy 每个实例的连接池策略
+// 一个 Client 的所有请求都需要通过 Client.sending 串行发送, 请求较大时单个连接会成为瓶颈
+type PoolPolicy struct {
+	MaxConns int // 每个实例最多建立的连接数, 小于 1 时按 1 处理
+	// 所有连接的未完成调用数都不小于该值时建立新的连接, 小于 1 时按 1 处理
+	MaxPending int
+	// 连接超过该时间没有被使用时关闭, 每个实例至少保留一个连接, 0 表示不关闭
+	IdleTimeout time.Duration
+}
+
+// DefaultPoolPolicy 每个实例只使用一个连接, 与不设置连接池时相同
+var DefaultPoolPolicy = &PoolPolicy{MaxConns: 1, MaxPending: 1}
+
+// pooledConn 连接池中的连接
+type pooledConn struct {
+	*client.Client
+	inflight int64     // 通过连接池发出且未完成的调用数, 包含还没有发送的调用
+	lastUsed time.Time // 最近一次被选中的时间, 由 connPool.mu 保护
+}
+
+// release 调用结束
+func (pc *pooledConn) release() {
+	atomic.AddInt64(&pc.inflight, -1)
+}
+
+// errPoolClosed 连接池已经被 drain 或 close, 需要重新获取连接池
+var errPoolClosed = errors.New("rpc client: 连接池已经关闭")
+
+// drainInterval drain 检查连接上未完成调用数的间隔
+const drainInterval = 10 * time.Millisecond
+
+// connPool 单个实例的连接池
+// 选择未完成调用数最少的连接, 所有连接都繁忙时建立新的连接, 不可用的连接会被移除, 空闲的连接会被关闭
+type connPool struct {
+	rpcAddr string
+	opt     *option.Option
+	policy  PoolPolicy
+
+	mu     sync.Mutex
+	conns  []*pooledConn
+	dials  []*pendingDial // 正在建立的连接, 与 conns 一起计入 MaxConns
+	closed bool           // 已经被 drain 或 close, 不再提供连接
+}
+
+// pendingDial 正在建立的连接, 没有可用连接的调用等待其结果, 不再各自建立连接
+type pendingDial struct {
+	done chan struct{} // 建立连接结束后关闭
+	err  error         // 建立连接的错误, done 关闭后可读
+}
+
+func newConnPool(rpcAddr string, opt *option.Option, p *PoolPolicy) *connPool {
+	policy := *DefaultPoolPolicy
+	if p != nil {
+		policy = *p
+	}
+	if policy.MaxConns < 1 {
+		policy.MaxConns = 1
+	}
+	if policy.MaxPending < 1 {
+		policy.MaxPending = 1
+	}
+	return &connPool{rpcAddr: rpcAddr, opt: opt, policy: policy}
+}
+
+// get 返回一个连接, 调用结束后需要调用 release, 连接池已经关闭时返回 errPoolClosed
+// 建立连接时不持有锁, 一个实例建立连接很慢时不会阻塞使用已有连接的调用
+// 正在建立的连接计入 MaxConns, 没有可用连接时等待正在建立的连接并共享其结果, 并发的第一批调用只建立一个连接
+func (p *connPool) get() (*pooledConn, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+		best := p.pick()
+		full := len(p.conns)+len(p.dials) >= p.policy.MaxConns
+		if best != nil && (atomic.LoadInt64(&best.inflight) < int64(p.policy.MaxPending) || full) {
+			p.acquire(best)
+			p.mu.Unlock()
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		// 没有可用的连接, 且建立连接的数量已经达到上限, 等待其中一个建立完成
+		d := p.dials[0]
+		p.mu.Unlock()
+		<-d.done
+		if d.err != nil {
+			return nil, d.err
+		}
+		p.mu.Lock()
+	}
+	d := &pendingDial{done: make(chan struct{})}
+	p.dials = append(p.dials, d)
+	p.mu.Unlock()
+
+	c, err := client.XDial(p.rpcAddr, p.opt)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, pd := range p.dials {
+		if pd == d {
+			p.dials = append(p.dials[:i], p.dials[i+1:]...)
+			break
+		}
+	}
+	d.err = err
+	close(d.done)
+	if p.closed {
+		if err == nil {
+			_ = c.Close()
+		}
+		return nil, errPoolClosed
+	}
+	if err != nil {
+		// 建立连接失败, 使用已有的连接
+		best := p.pick()
+		if best == nil {
+			return nil, err
+		}
+		p.acquire(best)
+		return best, nil
+	}
+	pc := &pooledConn{Client: c}
+	p.conns = append(p.conns, pc)
+	p.acquire(pc)
+	return pc, nil
+}
+
+// pick 移除不可用的连接, 返回未完成调用数最少的连接, 没有连接时返回 nil, 需要持有 p.mu
+func (p *connPool) pick() *pooledConn {
+	// 移除不可用的连接, 例如心跳超时或者读写出错
+	alive := p.conns[:0]
+	for _, pc := range p.conns {
+		if pc.IsAvailable() {
+			alive = append(alive, pc)
+		} else {
+			_ = pc.Close()
+		}
+	}
+	p.conns = alive
+
+	var best *pooledConn
+	for _, pc := range p.conns {
+		if best == nil || atomic.LoadInt64(&pc.inflight) < atomic.LoadInt64(&best.inflight) {
+			best = pc
+		}
+	}
+	return best
+}
+
+// acquire 选中连接 pc, 并关闭空闲的连接, 需要持有 p.mu
+func (p *connPool) acquire(pc *pooledConn) {
+	now := time.Now()
+	pc.lastUsed = now
+	atomic.AddInt64(&pc.inflight, 1)
+	p.shrink(now)
+}
+
+// shrink 关闭超过 IdleTimeout 没有被使用的连接
+func (p *connPool) shrink(now time.Time) {
+	if p.policy.IdleTimeout <= 0 {
+		return
+	}
+	alive := p.conns[:0]
+	for _, pc := range p.conns {
+		if atomic.LoadInt64(&pc.inflight) == 0 && now.Sub(pc.lastUsed) > p.policy.IdleTimeout {
+			_ = pc.Close()
+			continue
+		}
+		alive = append(alive, pc)
+	}
+	p.conns = alive
+}
+
+// size 返回连接数
+func (p *connPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// drain 关闭连接池, 等待所有连接上未完成的调用返回后关闭连接
+// 未完成的调用包含已经从连接池取出但还没有发送的调用, 超过 timeout 仍未返回的调用会随连接关闭而失败
+func (p *connPool) drain(timeout time.Duration) {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, pc := range conns {
+		go pc.drain(timeout)
+	}
+}
+
+// drain 等待通过连接池发出的调用全部返回后关闭连接
+func (pc *pooledConn) drain(timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(drainInterval)
+	defer tick.Stop()
+	defer func() { _ = pc.Close() }()
+	for atomic.LoadInt64(&pc.inflight) > 0 && pc.IsAvailable() {
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+// close 关闭连接池及所有连接
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns {
+		_ = pc.Close()
+	}
+	p.conns = nil
+	p.closed = true
+}
+
+// SetPoolPolicy 设置每个实例的连接池策略, 需要在发起调用前设置, p 为 nil 时每个实例只使用一个连接
+func (xc *XClient) SetPoolPolicy(p *PoolPolicy) {
+	xc.pool = p
+}
@@ -0,0 +1,235 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gorpc/client"
+)
+
+// StatusCode 调用错误的分类, 用于判断调用是否可以重试
+type StatusCode int
+
+const (
+	CodeOK               StatusCode = iota // 调用成功
+	CodeUnknown                            // 无法识别的错误, 例如服务端返回的业务错误
+	CodeCanceled                           // ctx 被取消
+	CodeDeadlineExceeded                   // 调用超时
+	CodeUnavailable                        // 连接不可用, 例如拨号失败, 连接断开, 心跳超时
+	CodeCircuitOpen                        // 所有实例均已熔断, 请求没有发出
+)
+
+// Code 返回错误对应的 StatusCode
+func Code(err error) StatusCode {
+	switch {
+	case err == nil:
+		return CodeOK
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	case errors.Is(err, ErrCircuitOpen):
+		return CodeCircuitOpen
+	case errors.Is(err, client.ErrShutdown), errors.Is(err, client.ErrUnavailable), errors.Is(err, client.ErrReconnecting),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		// 拨号阶段超时, 请求没有发出
+		errors.Is(err, client.ErrConnectTimeout):
+		return CodeUnavailable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return CodeDeadlineExceeded
+		}
+		return CodeUnavailable
+	}
+	return CodeUnknown
+}
+
+// RetryPolicy 重试策略, 在 Failover 和 Failtry 模式下, 对通过 XClient.SetIdempotent 标记为幂等的方法生效
+type RetryPolicy struct {
+	MaxAttempts       int            // 最大尝试次数(包含第一次), 小于等于 1 表示不重试
+	Backoff           client.Backoff // 两次尝试之间的退避时间
+	RetryableCodes    []StatusCode   // 可以重试的错误类型
+	PerAttemptTimeout time.Duration  // 每次尝试的超时时间, 0 表示只受 ctx 限制
+	// 重试预算: 每次调用积累 BudgetRatio 次重试额度, 最多积累 BudgetMax 次, 额度用完后不再重试
+	// 避免在大面积故障时重试成倍放大请求量, BudgetRatio 为 0 表示不限制
+	BudgetRatio float64
+	BudgetMax   float64
+}
+
+// DefaultRetryPolicy 默认的重试策略, 最多尝试 3 次, 重试次数不超过请求数的 20%
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts: 3,
+	Backoff: client.Backoff{
+		Initial:    50 * time.Millisecond,
+		Max:        time.Second,
+		Multiplier: 2,
+		Jitter:     0.2,
+	},
+	RetryableCodes: []StatusCode{CodeUnavailable, CodeDeadlineExceeded},
+	BudgetRatio:    0.2,
+	BudgetMax:      10,
+}
+
+// retryable 判断错误是否可以重试
+func (p *RetryPolicy) retryable(err error) bool {
+	code := Code(err)
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryBudget 重试预算, 令牌桶实现
+// 每次调用存入 ratio 个令牌, 每次重试消耗 1 个令牌, 令牌不足时放弃重试
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func newRetryBudget(ratio, max float64) *retryBudget {
+	return &retryBudget{ratio: ratio, max: max, tokens: max}
+}
+
+// deposit 每次调用时存入令牌
+func (b *retryBudget) deposit() {
+	if b.ratio == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+// withdraw 重试前取出令牌, 令牌不足时返回 false
+func (b *retryBudget) withdraw() bool {
+	if b.ratio == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// callWithRetry 按重试策略调用
+// reselect 为 true 时每次重试都通过 Discovery 重新选择实例, 并尽量避开失败过的实例, 否则重试同一个实例
+func (xc *XClient) callWithRetry(ctx context.Context, serviceMethod string, args, reply interface{}, reselect bool) error {
+	p := xc.retry
+	xc.budget.deposit()
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	tried := make(map[string]bool)
+	var rpcAddr string
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			if !p.retryable(err) || !xc.budget.withdraw() {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(p.Backoff.Duration(attempt - 1)):
+			}
+		}
+		if attempt == 0 || reselect {
+			addr, e := xc.pick(ctx, serviceMethod, args, tried)
+			if e != nil {
+				return e
+			}
+			rpcAddr = addr
+			tried[rpcAddr] = true
+		}
+		if err = xc.attempt(ctx, rpcAddr, serviceMethod, args, reply, p.PerAttemptTimeout); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// 调用方的 ctx 已经结束, 不再重试
+			return err
+		}
+	}
+	return err
+}
+
+// attempt 进行一次尝试, timeout 大于 0 时为本次尝试单独设置超时时间
+func (xc *XClient) attempt(ctx context.Context, rpcAddr, serviceMethod string, args, reply interface{}, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+}
+
+// pick 由 Balancer 从 Discovery 返回的实例中选择实例, 跳过熔断中的实例, 并尽量避开 exclude 中的实例
+// 先在不在 exclude 中的实例里选择, 都被熔断时再在所有实例里选择
+func (xc *XClient) pick(ctx context.Context, serviceMethod string, args interface{}, exclude map[string]bool) (string, error) {
+	if xc.balancer == nil {
+		return "", ErrUnsupportedMode
+	}
+	servers, err := xc.servers(serviceMethod)
+	if err != nil {
+		return "", err
+	}
+	if len(servers) == 0 {
+		return "", ErrNoServers
+	}
+	info := PickInfo{Ctx: ctx, ServiceMethod: serviceMethod, Args: args}
+	untried := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if !exclude[s] {
+			untried = append(untried, s)
+		}
+	}
+	passes := [][]string{untried}
+	if len(untried) < len(servers) {
+		passes = append(passes, servers)
+	}
+	for _, candidates := range passes {
+		for len(candidates) > 0 {
+			rpcAddr, err := xc.balancer.Pick(candidates, info)
+			if err != nil {
+				return "", err
+			}
+			if xc.allow(rpcAddr) {
+				return rpcAddr, nil
+			}
+			rest := remove(candidates, rpcAddr)
+			if len(rest) == len(candidates) {
+				// Balancer 返回了不在列表中的实例
+				break
+			}
+			candidates = rest
+		}
+	}
+	return "", ErrCircuitOpen
+}
+
+// remove 返回去除 s 之后的实例列表, 不修改原有的列表
+func remove(servers []string, s string) []string {
+	rest := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if server != s {
+			rest = append(rest, server)
+		}
+	}
+	return rest
+}
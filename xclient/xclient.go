@@ -3,66 +3,224 @@ package xclient
 import (
 	"context"
 	"io"
+	"log"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"gorpc/client"
 	"gorpc/option"
 )
 
 type XClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *option.Option
-	mu      sync.Mutex
-	clients map[string]*client.Client
+	d          Discovery
+	balancer   Balancer // 负载均衡器
+	opt        *option.Option
+	mu         sync.Mutex
+	clients    map[string]*connPool
+	failMode   FailMode        // 调用失败时的处理策略
+	backup     time.Duration   // Failbackup 模式下发送备份请求前的等待时间
+	retry      *RetryPolicy    // 重试策略, 默认为 DefaultRetryPolicy, nil 表示不重试
+	budget     *retryBudget    // 重试预算
+	idempotent map[string]bool // 幂等的方法, 只有幂等的方法才会重试
+	hedging    *HedgePolicy    // 对冲请求策略, nil 表示不发送对冲请求
+	readOnly   map[string]bool // 只读的方法, 只有只读的方法才会发送对冲请求
+	latencies  sync.Map        // 每个方法最近的调用延迟 map[string]*latencyWindow
+	// 熔断策略, nil 表示不熔断
+	breakerPolicy *BreakerPolicy
+	breakers      sync.Map // 每个实例的熔断器 map[string]*breaker
+	// 连接池策略, nil 表示每个实例只使用一个连接
+	pool *PoolPolicy
+	// 上次 reconcile 时的实例列表 []string, 实例列表没有变化时不需要 reconcile
+	// 每次调用都会无锁地与其比较, 只有实例列表变化时才获取 reconciling
+	reconciling sync.Mutex
+	known       atomic.Value
 }
 
+// SetBalancer 设置负载均衡器, 替换 NewXClient 时按 SelectMode 创建的内置 Balancer, 需要在发起调用前设置
+func (xc *XClient) SetBalancer(b Balancer) {
+	xc.balancer = b
+}
+
+// SetFailMode 设置调用失败时的处理策略, 需要在发起调用前设置
+func (xc *XClient) SetFailMode(mode FailMode) {
+	xc.failMode = mode
+}
+
+// SetBackupLatency 设置 Failbackup 模式下发送备份请求前的等待时间, 需要在发起调用前设置
+func (xc *XClient) SetBackupLatency(d time.Duration) {
+	xc.backup = d
+}
+
+// SetRetryPolicy 设置重试策略, 需要在发起调用前设置, 默认使用 DefaultRetryPolicy
+// p 为 nil 时关闭重试, Failover 和 Failtry 模式的行为与 Failfast 相同
+func (xc *XClient) SetRetryPolicy(p *RetryPolicy) {
+	xc.retry = p
+	if p != nil {
+		xc.budget = newRetryBudget(p.BudgetRatio, p.BudgetMax)
+	}
+}
+
+// SetIdempotent 将方法标记为幂等, 格式为 <service>.<method>, 需要在发起调用前设置
+// 只有幂等的方法在失败后才会按重试策略重试, 避免同一个请求被执行多次造成副作用
+func (xc *XClient) SetIdempotent(serviceMethods ...string) {
+	for _, serviceMethod := range serviceMethods {
+		xc.idempotent[serviceMethod] = true
+	}
+}
+
+// Close 关闭所有缓存的连接, Discovery 实现了 io.Closer 时一并关闭, 例如停止 GoRegistryDiscovery 的后台刷新
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
-	for key, c := range xc.clients {
-		_ = c.Close()
+	for key, p := range xc.clients {
+		p.close()
 		delete(xc.clients, key)
 	}
+	xc.mu.Unlock()
+	if c, ok := xc.d.(io.Closer); ok {
+		return c.Close()
+	}
 	return nil
 }
 
-// dial 复用 Client 进行调用
-// 1.检查 xc.clients 是否有缓存的 Client,
-//   如果有, 检查是否是可用状态, 如果是则返回缓存的 Client
-//   如果不可用, 则从缓存中删除
-// 2.如果步骤 1 没有返回缓存的 Client, 则说明需要创建新的 Client 缓存并返回
-func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
+// dial 从实例对应的连接池中获取连接进行调用, 调用结束后需要调用 release
+// 1.检查 xc.clients 是否有缓存的连接池, 如果没有则创建新的连接池缓存
+// 2.由连接池选择未完成调用数最少的连接, 连接池会移除不可用的连接, 并在需要时建立新的连接
+// 连接池在取出连接前被 reconcile 关闭时, 重新获取该实例的连接池
+func (xc *XClient) dial(rpcAddr string) (*pooledConn, error) {
+	for {
+		xc.mu.Lock()
+		p, ok := xc.clients[rpcAddr]
+		if !ok {
+			p = newConnPool(rpcAddr, xc.opt, xc.pool)
+			xc.clients[rpcAddr] = p
+		}
+		xc.mu.Unlock()
+		pc, err := p.get()
+		if err != errPoolClosed {
+			return pc, err
+		}
+		xc.mu.Lock()
+		if xc.clients[rpcAddr] == p {
+			delete(xc.clients, rpcAddr)
+		}
+		xc.mu.Unlock()
+	}
+}
+
+// drainTimeout 实例从 Discovery 中移除后, 等待其连接上未完成的调用返回的最长时间
+const drainTimeout = 10 * time.Second
+
+// servers 返回可以调用 serviceMethod 的实例, 并关闭已经不在 Discovery 中的实例的连接
+// Discovery 实现了 ServiceDiscovery 时只返回提供了被调用服务的实例
+func (xc *XClient) servers(serviceMethod string) ([]string, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	xc.reconcile(servers)
+	sd, ok := xc.d.(ServiceDiscovery)
+	dot := strings.LastIndex(serviceMethod, ".")
+	if !ok || dot < 0 {
+		return servers, nil
+	}
+	return sd.GetService(serviceMethod[:dot])
+}
+
+// reconcile 从缓存中删除不在 servers 中的实例的连接池, 等待其未完成的调用返回后关闭连接
+// 同时删除这些实例的熔断器, 以及 Balancer 为其记录的状态, 避免实例频繁变化时不断累积
+// 只在实例列表与上次 reconcile 时不同, 即 Discovery 刷新出新的实例列表后执行
+func (xc *XClient) reconcile(servers []string) {
+	known, _ := xc.known.Load().([]string)
+	if known != nil && equalServers(known, servers) {
+		return
+	}
+	xc.reconciling.Lock()
+	defer xc.reconciling.Unlock()
+	// 等待锁的过程中其他调用可能已经完成了 reconcile
+	known, _ = xc.known.Load().([]string)
+	if known != nil && equalServers(known, servers) {
+		return
+	}
+	alive := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		alive[s] = true
+	}
+	// Balancer 只会见到出现在某次实例列表中的实例, 因此只需要通知上次列表中被移除的实例
+	if f, ok := xc.balancer.(Forgetter); ok {
+		for _, s := range known {
+			if !alive[s] {
+				f.Forget(s)
+			}
+		}
+	}
+	// 其他调用可能正在无锁地读取 known, 因此保存新的副本而不是复用原有的底层数组
+	xc.known.Store(append(make([]string, 0, len(servers)), servers...))
+	xc.breakers.Range(func(rpcAddr, _ interface{}) bool {
+		if !alive[rpcAddr.(string)] {
+			xc.breakers.Delete(rpcAddr)
+		}
+		return true
+	})
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	c, ok := xc.clients[rpcAddr]
-	if ok && !c.IsAvailable() {
-		_ = c.Close()
-		delete(xc.clients, rpcAddr)
-		c = nil
-	}
-	if c == nil {
-		var err error
-		c, err = client.XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
+	for rpcAddr, p := range xc.clients {
+		if !alive[rpcAddr] {
+			delete(xc.clients, rpcAddr)
+			p.drain(drainTimeout)
+		}
+	}
+}
+
+// equalServers 判断两个实例列表是否相同
+func equalServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
-		xc.clients[rpcAddr] = c
 	}
-	return c, nil
+	return true
 }
 
-func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+// call 调用指定的实例, 将调用的开始和结束通知给 Balancer, 并将结果上报给实例的熔断器
+func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	if o, ok := xc.balancer.(Observer); ok {
+		start := time.Now()
+		o.Start(rpcAddr)
+		defer func() { o.Done(rpcAddr, time.Since(start), err) }()
+	}
+	if b := xc.breaker(rpcAddr); b != nil {
+		defer func() { b.done(err) }()
+	}
 	c, err := xc.dial(rpcAddr)
 	if err != nil {
 		return err
 	}
+	defer c.release()
 	return c.Call(ctx, serviceMethod, args, reply)
 }
 
+// Call 选择一个服务实例进行调用
+// 只有幂等的方法才会按 FailMode 处理失败, 其余方法的行为与 Failfast 相同
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+	if xc.hedging != nil && xc.readOnly[serviceMethod] {
+		return xc.callHedged(ctx, serviceMethod, args, reply)
+	}
+	if xc.idempotent[serviceMethod] {
+		switch {
+		case xc.failMode == Failbackup:
+			return xc.callBackup(ctx, serviceMethod, args, reply)
+		case xc.failMode == Failover && xc.retry != nil:
+			return xc.callWithRetry(ctx, serviceMethod, args, reply, true)
+		case xc.failMode == Failtry && xc.retry != nil:
+			return xc.callWithRetry(ctx, serviceMethod, args, reply, false)
+		}
+	}
+	rpcAddr, err := xc.pick(ctx, serviceMethod, args, nil)
 	if err != nil {
 		return err
 	}
@@ -73,7 +231,7 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply i
 // 如果任意一个实例发生错误, 则返回其中一个错误, 并取消 context 传播
 // 如果调用成功, 则返回其中一个的结果
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	servers, err := xc.d.GetAll()
+	servers, err := xc.servers(serviceMethod)
 	if err != nil {
 		return err
 	}
@@ -88,10 +246,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 		wg.Add(1)
 		go func(rpcAddr string) {
 			defer wg.Done()
-			var clonedReply interface{}
-			if reply != nil {
-				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
-			}
+			clonedReply := newReply(reply)
 			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
 			mu.Lock()
 			// 快速失败, 若失败马上取消 context
@@ -100,7 +255,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 				cancel()
 			}
 			if err == nil && !replyDone {
-				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
+				setReply(reply, clonedReply)
 				replyDone = true
 			}
 			mu.Unlock()
@@ -110,10 +265,44 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	return e
 }
 
+// newReply 创建与 reply 类型相同的新实例, 并发调用多个实例时各自接收响应, reply 为 nil 时返回 nil
+func newReply(reply interface{}) interface{} {
+	if reply == nil {
+		return nil
+	}
+	return reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+}
+
+// setReply 将 newReply 创建的 src 中的响应拷贝到 reply
+func setReply(reply, src interface{}) {
+	if reply == nil {
+		return
+	}
+	reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(src).Elem())
+}
+
 var _ io.Closer = (*XClient)(nil)
 
 // NewXClient 创建一个支持负载均衡的客户端
 // 接收参数: 服务发现实例 Discovery, 负载均衡模式 SelectMode 以及协议选项 option.Option
+// 负载均衡器由 NewBalancer 按 SelectMode 创建, 可以通过 SetBalancer 替换为自定义的 Balancer
+// 不支持的 SelectMode 在创建时记录日志, 并退化为 RandomSelect
+// XClient 持有 d, Close 时会关闭实现了 io.Closer 的 d, 因此 d 不能在多个 XClient 之间共享
 func NewXClient(d Discovery, mode SelectMode, opt *option.Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*client.Client)}
+	b, err := NewBalancer(mode, d)
+	if err != nil {
+		log.Printf("rpc client: 负载均衡模式 %d 不可用, 使用 RandomSelect: %v", mode, err)
+		b = NewRandomBalancer()
+	}
+	return &XClient{
+		d:          d,
+		balancer:   b,
+		opt:        opt,
+		clients:    make(map[string]*connPool),
+		backup:     defaultBackupLatency,
+		retry:      DefaultRetryPolicy,
+		budget:     newRetryBudget(DefaultRetryPolicy.BudgetRatio, DefaultRetryPolicy.BudgetMax),
+		idempotent: make(map[string]bool),
+		readOnly:   make(map[string]bool),
+	}
 }
@@ -0,0 +1,663 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorpc/client"
+	"gorpc/registry"
+	"gorpc/server"
+)
+
+type Foo int
+
+type Args struct {
+	Num1, Num2 int
+}
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// startServer 启动服务并返回 tcp@addr 格式的地址
+func startServer() string {
+	var foo Foo
+	s := server.NewServer()
+	_ = s.Register(&foo)
+	lis, _ := net.Listen("tcp", ":0")
+	go s.Accept(lis)
+	return "tcp@" + lis.Addr().String()
+}
+
+// deadAddr 返回一个无法连接的地址
+func deadAddr() string {
+	lis, _ := net.Listen("tcp", ":0")
+	_ = lis.Close()
+	return "tcp@" + lis.Addr().String()
+}
+
+// blackholeAddr 返回一个接收连接和数据, 但从不回复的地址, 模拟卡死的实例
+func blackholeAddr() string {
+	lis, _ := net.Listen("tcp", ":0")
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+	return "tcp@" + lis.Addr().String()
+}
+
+func TestXClient_Retry(t *testing.T) {
+	d := NewMultiServersDiscovery([]string{deadAddr(), startServer()})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetryPolicy(DefaultRetryPolicy)
+
+	t.Run("not idempotent", func(t *testing.T) {
+		failed := 0
+		for i := 0; i < 4; i++ {
+			var reply int
+			if err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: i}, &reply); err != nil {
+				_assert(Code(err) == CodeUnavailable, "expect CodeUnavailable, but got %v", err)
+				failed++
+			}
+		}
+		_assert(failed == 2, "expect half of the calls to fail without retry, but got %d", failed)
+	})
+	t.Run("idempotent", func(t *testing.T) {
+		xc.SetIdempotent("Foo.Sum")
+		for i := 0; i < 4; i++ {
+			var reply int
+			err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: i}, &reply)
+			_assert(err == nil && reply == 2*i, "expect retry to succeed, but got %v", err)
+		}
+	})
+}
+
+// recordingBalancer 记录每次选择的实例
+type recordingBalancer struct {
+	Balancer
+	picked []string
+}
+
+func (b *recordingBalancer) Pick(servers []string, info PickInfo) (string, error) {
+	rpcAddr, err := b.Balancer.Pick(servers, info)
+	b.picked = append(b.picked, rpcAddr)
+	return rpcAddr, err
+}
+
+func TestXClient_Failtry(t *testing.T) {
+	// 接收连接后立即关闭, 每次尝试都会重新建立连接
+	lis, _ := net.Listen("tcp", ":0")
+	flaky := &countingListener{Listener: lis}
+	defer func() { _ = lis.Close() }()
+	go func() {
+		for {
+			conn, err := flaky.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	flakyAddr := "tcp@" + lis.Addr().String()
+	d := NewMultiServersDiscovery([]string{flakyAddr, startServer()})
+	// 没有调用 SetRetryPolicy, 使用 DefaultRetryPolicy
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	b := &recordingBalancer{Balancer: xc.balancer}
+	xc.SetBalancer(b)
+	xc.SetIdempotent("Foo.Sum")
+
+	xc.SetFailMode(Failtry)
+	failed := 0
+	for i := 0; i < 2; i++ {
+		b.picked = nil
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+			_assert(len(b.picked) == 1 && b.picked[0] == flakyAddr, "expect Failtry to keep the same instance, but picked %v", b.picked)
+			failed++
+		}
+	}
+	_assert(failed == 1, "expect the call to the flaky instance to fail, but got %d failures", failed)
+	accepted := atomic.LoadInt64(&flaky.accepted)
+	_assert(accepted == int64(DefaultRetryPolicy.MaxAttempts), "expect %d attempts on the same instance, but got %d", DefaultRetryPolicy.MaxAttempts, accepted)
+
+	xc.SetFailMode(Failover)
+	for i := 0; i < 2; i++ {
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect Failover to retry another instance by default, but got %v", err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5, 1)
+	_assert(b.withdraw(), "expect the initial budget to allow a retry")
+	_assert(!b.withdraw(), "expect the budget to be exhausted")
+	b.deposit()
+	_assert(!b.withdraw(), "expect half a token to be not enough")
+	b.deposit()
+	_assert(b.withdraw(), "expect the budget to be refilled by deposits")
+}
+
+func TestXClient_Failbackup(t *testing.T) {
+	d := NewMultiServersDiscovery([]string{blackholeAddr(), startServer()})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetIdempotent("Foo.Sum")
+
+	call := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		var reply int
+		return xc.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}
+	t.Run("failfast", func(t *testing.T) {
+		xc.SetFailMode(Failfast)
+		failed := 0
+		for i := 0; i < 2; i++ {
+			if err := call(); err != nil {
+				_assert(Code(err) == CodeDeadlineExceeded, "expect CodeDeadlineExceeded, but got %v", err)
+				failed++
+			}
+		}
+		_assert(failed == 1, "expect the call to the blackhole to time out, but got %d failures", failed)
+	})
+	t.Run("failbackup", func(t *testing.T) {
+		xc.SetFailMode(Failbackup)
+		for i := 0; i < 4; i++ {
+			_assert(call() == nil, "expect the backup request to succeed")
+		}
+	})
+}
+
+func TestXClient_Hedge(t *testing.T) {
+	d := NewMultiServersDiscovery([]string{blackholeAddr(), blackholeAddr(), startServer()})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetReadOnly("Foo.Sum")
+	xc.SetHedgePolicy(&HedgePolicy{Delay: 20 * time.Millisecond, MaxAttempts: 3})
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		var reply int
+		err := xc.Call(ctx, "Foo.Sum", Args{Num1: i, Num2: i}, &reply)
+		cancel()
+		_assert(err == nil && reply == 2*i, "expect a hedged request to succeed, but got %v", err)
+	}
+}
+
+func TestLatencyWindow_Percentile(t *testing.T) {
+	var w latencyWindow
+	_, ok := w.percentile(0.95)
+	_assert(!ok, "expect no percentile without samples")
+	for i := 1; i <= 2*latencyWindowSize; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	// 只保留最近的 latencyWindowSize 个样本, 即 101ms ~ 200ms
+	p95, ok := w.percentile(0.95)
+	_assert(ok && p95 == 196*time.Millisecond, "expect p95 to be 196ms, but got %v", p95)
+}
+
+func TestXClient_Breaker(t *testing.T) {
+	dead := deadAddr()
+	d := NewMultiServersDiscovery([]string{dead, startServer()})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetBreakerPolicy(&BreakerPolicy{ConsecutiveFailures: 1, OpenTimeout: time.Minute})
+	failed := 0
+	for i := 0; i < 6; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: i}, &reply); err != nil {
+			failed++
+		}
+	}
+	_assert(failed == 1, "expect only the first call to the dead instance to fail, but got %d failures", failed)
+	_assert(xc.BreakerStates()[dead] == BreakerOpen, "expect the breaker of the dead instance to be open")
+
+	_ = d.Update([]string{dead})
+	err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, new(int))
+	_assert(errors.Is(err, ErrCircuitOpen) && Code(err) == CodeCircuitOpen, "expect CodeCircuitOpen, but got %v", err)
+	_ = d.Update([]string{startServer()})
+	_ = xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, new(int))
+	_, ok := xc.BreakerStates()[dead]
+	_assert(!ok, "expect the breaker of the removed instance to be deleted")
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	b := newBreaker(&BreakerPolicy{ConsecutiveFailures: 2, OpenTimeout: 50 * time.Millisecond})
+	unavailable := client.ErrUnavailable
+	b.done(unavailable)
+	_assert(b.State() == BreakerClosed, "expect one failure to keep the breaker closed")
+	b.done(unavailable)
+	_assert(b.State() == BreakerOpen && !b.allow(), "expect two consecutive failures to open the breaker")
+	time.Sleep(60 * time.Millisecond)
+	_assert(b.allow() && b.State() == BreakerHalfOpen, "expect a probe after the open timeout")
+	_assert(!b.allow(), "expect only one probe in half-open state")
+	b.done(nil)
+	_assert(b.State() == BreakerClosed, "expect a successful probe to close the breaker")
+}
+
+func TestMultiServersDiscovery_Weighted(t *testing.T) {
+	d := NewWeightedMultiServersDiscovery(map[string]int{"a": 5, "b": 1, "c": 1})
+	t.Run("smooth weighted round robin", func(t *testing.T) {
+		var picks string
+		for i := 0; i < 7; i++ {
+			s, _ := d.Get(WeightedRoundRobinSelect)
+			picks += s
+		}
+		_assert(picks == "aabacaa", "expect the nginx smooth order aabacaa, but got %s", picks)
+	})
+	t.Run("weighted random", func(t *testing.T) {
+		counts := make(map[string]int)
+		for i := 0; i < 7000; i++ {
+			s, _ := d.Get(WeightedRandomSelect)
+			counts[s]++
+		}
+		_assert(counts["a"] > 4500 && counts["b"] > 700 && counts["c"] > 700, "unexpected distribution %v", counts)
+	})
+}
+
+func TestBalancer_Load(t *testing.T) {
+	servers := []string{"a", "b"}
+	t.Run("least pending", func(t *testing.T) {
+		b := NewLeastPendingBalancer()
+		b.(Observer).Start("a")
+		for i := 0; i < 10; i++ {
+			rpcAddr, err := b.Pick(servers, PickInfo{})
+			_assert(err == nil && rpcAddr == "b", "expect the instance with fewer pending calls, but got %s", rpcAddr)
+		}
+	})
+	t.Run("p2c", func(t *testing.T) {
+		b := NewP2CBalancer()
+		o := b.(Observer)
+		o.Start("a")
+		o.Done("a", time.Second, nil)
+		o.Start("b")
+		o.Done("b", time.Millisecond, nil)
+		for i := 0; i < 10; i++ {
+			rpcAddr, err := b.Pick(servers, PickInfo{})
+			_assert(err == nil && rpcAddr == "b", "expect the instance with lower latency, but got %s", rpcAddr)
+		}
+	})
+}
+
+// firstBalancer 总是选择第一个实例
+type firstBalancer struct{}
+
+func (firstBalancer) Pick(servers []string, _ PickInfo) (string, error) {
+	return servers[0], nil
+}
+
+func TestXClient_SetBalancer(t *testing.T) {
+	d := NewMultiServersDiscovery([]string{"a", "b", "c"})
+	xc := NewXClient(d, RandomSelect, nil)
+	xc.SetBalancer(firstBalancer{})
+	rpcAddr, err := xc.pick(context.Background(), "Foo.Sum", nil, nil)
+	_assert(err == nil && rpcAddr == "a", "expect the custom balancer to be used, but got %s", rpcAddr)
+	rpcAddr, err = xc.pick(context.Background(), "Foo.Sum", nil, map[string]bool{"a": true})
+	_assert(err == nil && rpcAddr == "b", "expect excluded instances to be skipped, but got %s", rpcAddr)
+
+	// 不支持的 SelectMode 退化为 RandomSelect
+	xc = NewXClient(d, SelectMode(100), nil)
+	_, err = xc.pick(context.Background(), "Foo.Sum", nil, nil)
+	_assert(err == nil, "expect the unsupported mode to fall back to RandomSelect, but got %v", err)
+}
+
+type userArgs struct {
+	UserID string
+}
+
+func (a userArgs) HashKey() string {
+	return a.UserID
+}
+
+func TestXClient_ConsistentHash(t *testing.T) {
+	d := NewMultiServersDiscovery([]string{"a", "b", "c", "d"})
+	xc := NewXClient(d, ConsistentHashSelect, nil)
+	before := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		rpcAddr, _ := xc.pick(context.Background(), "Foo.Sum", userArgs{UserID: user}, nil)
+		again, _ := xc.pick(WithHashKey(context.Background(), user), "Foo.Sum", nil, nil)
+		_assert(rpcAddr == again, "expect the same key to land on the same instance")
+		before[user] = rpcAddr
+	}
+	// 移除一个实例后, 只有原本落在该实例上的键会重新映射
+	_ = d.Update([]string{"a", "b", "c"})
+	for user, prev := range before {
+		rpcAddr, _ := xc.pick(WithHashKey(context.Background(), user), "Foo.Sum", nil, nil)
+		_assert(prev == "d" || rpcAddr == prev, "expect %s to stay on %s, but got %s", user, prev, rpcAddr)
+	}
+}
+
+func TestXClient_BroadcastAll(t *testing.T) {
+	live, dead, blackhole := startServer(), deadAddr(), blackholeAddr()
+	xc := NewXClient(NewMultiServersDiscovery([]string{live, dead, blackhole}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	t.Run("all", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		var reply int
+		results, err := xc.BroadcastAll(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && len(results) == 3, "expect a result for every instance, but got %v", err)
+		_assert(results[live].Err == nil && *results[live].Reply.(*int) == 3, "expect the live instance to reply 3")
+		_assert(Code(results[dead].Err) == CodeUnavailable, "expect the dead instance to be unavailable")
+		_assert(Code(results[blackhole].Err) == CodeDeadlineExceeded, "expect the stuck instance to time out")
+	})
+	t.Run("fork", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		var reply int
+		start := time.Now()
+		err := xc.Fork(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect the first success, but got %v", err)
+		_assert(time.Since(start) < 200*time.Millisecond, "expect fork to return without waiting for the stuck instance")
+	})
+	t.Run("quorum", func(t *testing.T) {
+		xc := NewXClient(NewMultiServersDiscovery([]string{live, startServer(), dead}), RandomSelect, nil)
+		defer func() { _ = xc.Close() }()
+		var reply int
+		results, err := xc.Quorum(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply, 2)
+		succeeded := 0
+		for _, r := range results {
+			if r.Err == nil {
+				succeeded++
+			}
+		}
+		_assert(err == nil && succeeded == 2, "expect 2 successes, but got %d, %v", succeeded, err)
+		_, err = xc.Quorum(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply, 3)
+		_assert(errors.Is(err, ErrQuorum), "expect ErrQuorum, but got %v", err)
+	})
+}
+
+func TestXClient_Reconcile(t *testing.T) {
+	a, b := startServer(), startServer()
+	d := NewMultiServersDiscovery([]string{a, b})
+	xc := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	_ = xc.Broadcast(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(len(xc.clients) == 2 && xc.clients[b].size() == 1, "expect a cached client for every instance")
+	removed := xc.clients[b].conns[0]
+
+	_ = d.Update([]string{a})
+	err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect the call to succeed, but got %v", err)
+	xc.mu.Lock()
+	_, ok := xc.clients[b]
+	xc.mu.Unlock()
+	_assert(!ok, "expect the removed instance to be dropped from the cache")
+	time.Sleep(50 * time.Millisecond)
+	_assert(!removed.IsAvailable(), "expect the removed instance's client to be closed")
+
+	// 实例列表没有变化时不获取 reconciling
+	xc.reconciling.Lock()
+	done := make(chan error, 1)
+	go func() { done <- xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, new(int)) }()
+	select {
+	case err = <-done:
+		_assert(err == nil, "expect the call to succeed, but got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect an unchanged server list to skip the reconcile lock")
+	}
+	xc.reconciling.Unlock()
+}
+
+func TestConnPool(t *testing.T) {
+	p := newConnPool(startServer(), nil, &PoolPolicy{MaxConns: 2, MaxPending: 1, IdleTimeout: 50 * time.Millisecond})
+	defer p.close()
+	c1, err := p.get()
+	_assert(err == nil && p.size() == 1, "expect the pool to dial lazily, but got %v", err)
+	c2, _ := p.get()
+	_assert(c2 != c1 && p.size() == 2, "expect a new connection when all connections are busy")
+	c3, _ := p.get()
+	_assert(p.size() == 2, "expect the pool not to grow beyond MaxConns")
+	c1.release()
+	c2.release()
+	c3.release()
+	var reply int
+	err = c3.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect the pooled connection to work, but got %v", err)
+
+	time.Sleep(100 * time.Millisecond)
+	c, _ := p.get()
+	_assert(p.size() == 1, "expect idle connections to be closed, but got %d", p.size())
+	c.release()
+	_ = c.Close()
+	c, err = p.get()
+	_assert(err == nil && c.IsAvailable() && p.size() == 1, "expect the closed connection to be replaced, but got %v", err)
+	c.release()
+}
+
+// countingListener 记录接收的连接数
+type countingListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestConnPool_ConcurrentDial(t *testing.T) {
+	var foo Foo
+	s := server.NewServer()
+	_ = s.Register(&foo)
+	for _, policy := range []*PoolPolicy{nil, {MaxConns: 3, MaxPending: 1}} {
+		lis, _ := net.Listen("tcp", ":0")
+		l := &countingListener{Listener: lis}
+		go s.Accept(l)
+		p := newConnPool("tcp@"+lis.Addr().String(), nil, policy)
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := p.get()
+				_assert(err == nil, "expect a connection, but got %v", err)
+				time.Sleep(10 * time.Millisecond)
+				c.release()
+			}()
+		}
+		wg.Wait()
+		time.Sleep(20 * time.Millisecond)
+		accepted := atomic.LoadInt64(&l.accepted)
+		_assert(accepted == int64(p.policy.MaxConns) && p.size() == p.policy.MaxConns,
+			"expect %d dials for concurrent first calls, but got %d", p.policy.MaxConns, accepted)
+		p.close()
+		_ = lis.Close()
+	}
+}
+
+func TestConnPool_Drain(t *testing.T) {
+	p := newConnPool(startServer(), nil, nil)
+	c, err := p.get()
+	_assert(err == nil, "expect a connection, but got %v", err)
+	// 已经取出但还没有发送的调用不会因为 drain 而失败
+	p.drain(time.Second)
+	time.Sleep(30 * time.Millisecond)
+	var reply int
+	err = c.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect the picked connection to stay open, but got %v", err)
+	c.release()
+	time.Sleep(30 * time.Millisecond)
+	_assert(!c.IsAvailable(), "expect the connection to be closed after the call")
+	_, err = p.get()
+	_assert(err == errPoolClosed, "expect a drained pool to refuse new calls, but got %v", err)
+}
+
+// startRegistry 启动注册中心, 并注册 servers
+func startRegistry(servers ...string) *httptest.Server {
+	ts := httptest.NewServer(registry.NewRegistry(time.Minute))
+	for _, s := range servers {
+		req, _ := http.NewRequest("POST", ts.URL, nil)
+		req.Header.Set("X-Gorpc-Servers", s)
+		resp, _ := http.DefaultClient.Do(req)
+		_ = resp.Body.Close()
+	}
+	return ts
+}
+
+func TestGoRegistryDiscovery_Stale(t *testing.T) {
+	ts := startRegistry("tcp@a", "tcp@b")
+	d := NewGoRegistryDiscovery(ts.URL, 20*time.Millisecond)
+	defer func() { _ = d.Close() }()
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 2, "expect 2 servers, but got %v %v", servers, err)
+	last, err := d.LastRefresh()
+	_assert(!last.IsZero() && err == nil, "expect a successful refresh")
+
+	// 注册中心不可用时继续使用旧的服务列表
+	ts.Close()
+	time.Sleep(60 * time.Millisecond)
+	servers, err = d.GetAll()
+	_assert(err == nil && len(servers) == 2, "expect the last known servers, but got %v %v", servers, err)
+	_, err = d.LastRefresh()
+	_assert(err != nil, "expect the refresh error to be exposed")
+
+	d.SetMaxStaleness(10 * time.Millisecond)
+	_, err = d.GetAll()
+	_assert(errors.Is(err, ErrStale), "expect ErrStale, but got %v", err)
+}
+
+func TestGoRegistryDiscovery_Failover(t *testing.T) {
+	// 两个注册中心的版本号相同, 切换后不能把旧节点的版本号发给新节点
+	primary := startRegistry("tcp@a")
+	secondary := startRegistry("tcp@b")
+	defer secondary.Close()
+	d := NewGoRegistryWatchDiscovery(primary.URL+","+secondary.URL, time.Hour)
+	defer func() { _ = d.Close() }()
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 1 && servers[0] == "tcp@a", "expect the first registry to be used, but got %v %v", servers, err)
+
+	// 第一个注册中心不可用后, watch 立即切换到下一个
+	primary.Close()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if servers, _ = d.GetAll(); len(servers) == 1 && servers[0] == "tcp@b" {
+			break
+		}
+	}
+	_assert(len(servers) == 1 && servers[0] == "tcp@b", "expect the servers of the second registry, but got %v", servers)
+	_assert(d.Refresh() == nil, "expect the refresh to use the second registry")
+}
+
+func TestGoRegistryDiscovery_Apply(t *testing.T) {
+	d := newGoRegistryDiscovery("tcp@registry", time.Hour)
+	state := func(revision, seq uint64, servers ...string) *registryState {
+		return &registryState{servers: servers, revision: revision, registry: "tcp@registry", seq: seq}
+	}
+	_ = d.apply(state(5, 2, "tcp@a", "tcp@b"), nil)
+	// 较早发出的请求较晚返回, 版本号更旧的服务列表被丢弃
+	_ = d.apply(state(3, 1, "tcp@a"), nil)
+	servers, _ := d.MultiServersDiscovery.GetAll()
+	_assert(len(servers) == 2, "expect the older state to be rejected, but got %v", servers)
+	// 注册中心重启后版本号变小, 较晚发出的请求仍然会被应用
+	_ = d.apply(state(1, 3, "tcp@c"), nil)
+	servers, _ = d.MultiServersDiscovery.GetAll()
+	_assert(len(servers) == 1 && servers[0] == "tcp@c", "expect a restarted registry to be followed, but got %v", servers)
+}
+
+func TestGoRegistryDiscovery_Watch(t *testing.T) {
+	ts := startRegistry("tcp@a")
+	defer ts.Close()
+	// 刷新间隔很长, 服务列表只能通过 watch 更新
+	d := NewGoRegistryWatchDiscovery(ts.URL, time.Hour)
+	defer func() { _ = d.Close() }()
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 1, "expect 1 server, but got %v %v", servers, err)
+
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	req, _ := http.NewRequest("POST", ts.URL, nil)
+	req.Header.Set("X-Gorpc-Servers", "tcp@b")
+	resp, _ := http.DefaultClient.Do(req)
+	_ = resp.Body.Close()
+	for len(servers) != 2 && time.Since(start) < time.Second {
+		time.Sleep(time.Millisecond)
+		servers, _ = d.GetAll()
+	}
+	_assert(len(servers) == 2, "expect the new server to be watched, but got %v", servers)
+	_assert(time.Since(start) < 100*time.Millisecond, "expect the watch to update within milliseconds, but took %v", time.Since(start))
+}
+
+func TestGoRegistryDiscovery_Service(t *testing.T) {
+	ts := startRegistry("tcp@legacy")
+	defer ts.Close()
+	register := func(addr, services string) {
+		req, _ := http.NewRequest("POST", ts.URL, nil)
+		req.Header.Set("X-Gorpc-Servers", addr)
+		req.Header.Set("X-Gorpc-Services", services)
+		resp, _ := http.DefaultClient.Do(req)
+		_ = resp.Body.Close()
+	}
+	register("tcp@foo", "Foo")
+	register("tcp@bar", "Bar,Foo")
+
+	resp, _ := http.Get(ts.URL + "?service=Bar")
+	_ = resp.Body.Close()
+	_assert(resp.Header.Get("X-Gorpc-Servers") == "tcp@bar,tcp@legacy", "unexpected servers %s", resp.Header.Get("X-Gorpc-Servers"))
+
+	d := NewGoRegistryDiscovery(ts.URL, time.Hour)
+	servers, err := d.GetService("Bar")
+	_assert(err == nil && fmt.Sprint(servers) == "[tcp@bar tcp@legacy]", "unexpected servers %v %v", servers, err)
+	xc := NewXClient(d, RandomSelect, nil)
+	servers, _ = xc.servers("Foo.Sum")
+	_assert(len(servers) == 3, "expect all servers to host Foo, but got %v", servers)
+	servers, _ = xc.servers("Baz.Sum")
+	_assert(fmt.Sprint(servers) == "[tcp@legacy]", "expect only the server with unknown services, but got %v", servers)
+	_ = xc.Close()
+	_assert(d.ctx.Err() != nil, "expect XClient.Close to stop the discovery")
+}
+
+func TestGoRegistryDiscovery_Metadata(t *testing.T) {
+	ts := startRegistry("tcp@legacy")
+	defer ts.Close()
+	h := registry.HeartbeatItem(ts.URL, registry.ServerItem{
+		Addr:     "tcp@canary",
+		Services: []string{"Foo"},
+		Weight:   5,
+		Version:  "1.2.0",
+		Zone:     "zone-a",
+		Tags:     map[string]string{"canary": "true"},
+	}, time.Hour)
+	defer func() { _ = h.Stop() }()
+	d := NewGoRegistryDiscovery(ts.URL, 10*time.Millisecond)
+	defer func() { _ = d.Close() }()
+	var md Metadata
+	var ok bool
+	for start := time.Now(); !ok && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		md, ok = d.Metadata("tcp@canary")
+	}
+	_assert(ok && md.Version == "1.2.0" && md.Zone == "zone-a" && md.Tags["canary"] == "true", "unexpected metadata %v", md)
+	_assert(d.Weight("tcp@canary") == 5 && d.Weight("tcp@legacy") == 1, "expect the weight to come from metadata")
+	_, ok = d.Metadata("tcp@legacy")
+	_assert(!ok, "expect no metadata for a server registered with headers")
+	servers, _ := d.GetService("Bar")
+	_assert(fmt.Sprint(servers) == "[tcp@legacy]", "expect services from the JSON registration, but got %v", servers)
+}